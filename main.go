@@ -1,20 +1,24 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
 	"sync"
 
 	"git.aqq.me/go/app/appconf"
 	"git.aqq.me/go/app/launcher"
 	"github.com/iph0/conf/envconf"
 	"github.com/iph0/conf/fileconf"
+	"github.com/kak-tus/corrie/metrics"
+	"github.com/kak-tus/corrie/pipeline"
 	"github.com/kak-tus/corrie/reader"
 	"github.com/kak-tus/corrie/writer"
 	"github.com/kak-tus/healthcheck"
 )
 
-var rdr *reader.Reader
-var wrt *writer.Writer
-
 func init() {
 	fileLdr := fileconf.NewLoader("etc", "/etc")
 	envLdr := envconf.NewLoader()
@@ -27,43 +31,176 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "shards" {
+		shards(os.Args[2:])
+		return
+	}
+
 	launcher.Run(func() error {
 		healthcheck.Add("/healthcheck", func() (healthcheck.State, string) {
 			return healthcheck.StatePassing, "ok"
 		})
 
-		rdr = reader.GetReader()
+		for _, p := range pipeline.GetPipelines() {
+			err := p.Writer.Ping()
+			if err != nil {
+				return fmt.Errorf("pipeline %s: %v", p.Name, err)
+			}
+		}
+
+		for _, p := range pipeline.GetPipelines() {
+			go p.Writer.Start()
+
+			healthcheck.Add("/ready/"+p.Name, readyPipeline(p))
+			healthcheck.Add("/status/"+p.Name, statusPipeline(p))
+		}
 
-		wrt = writer.GetWriter()
-		go wrt.Start()
+		// Liveness doesn't depend on RabbitMQ and Clickhouse, to not restart
+		// pods, if they are temporary down
+		healthcheck.Add("/live", func() (healthcheck.State, string) {
+			return healthcheck.StatePassing, "ok"
+		})
 
+		healthcheck.Add("/ready", ready)
 		healthcheck.Add("/status", status)
+		healthcheck.Add("/limits", limits)
+
+		// Served by healthcheck listener
+		http.Handle("/metrics", metrics.Handler())
 
 		return nil
 	})
 }
 
-func status() (healthcheck.State, string) {
+type pipelineStatus struct {
+	Reader reader.Status `json:"reader"`
+	Writer writer.Status `json:"writer"`
+}
+
+func (st pipelineStatus) accessible() bool {
+	return st.Reader.Accessible && st.Writer.Accessible
+}
+
+// components checks reader and writer in parallel
+func components(p *pipeline.Pipeline) pipelineStatus {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	var rs bool
+	var st pipelineStatus
+
 	go func() {
-		rs = rdr.IsAccessible()
+		st.Reader = p.Reader.Status()
 		wg.Done()
 	}()
 
-	var ws bool
 	go func() {
-		ws = wrt.IsAccessible()
+		st.Writer = p.Writer.Status()
 		wg.Done()
 	}()
 
 	wg.Wait()
 
-	if rs && ws {
+	return st
+}
+
+// pipelinesStatus checks all pipelines in parallel
+func pipelinesStatus() map[string]pipelineStatus {
+	var wg sync.WaitGroup
+	var m sync.Mutex
+
+	res := make(map[string]pipelineStatus)
+
+	for _, p := range pipeline.GetPipelines() {
+		wg.Add(1)
+
+		go func(p *pipeline.Pipeline) {
+			st := components(p)
+
+			m.Lock()
+			res[p.Name] = st
+			m.Unlock()
+
+			wg.Done()
+		}(p)
+	}
+
+	wg.Wait()
+
+	return res
+}
+
+func ready() (healthcheck.State, string) {
+	for _, st := range pipelinesStatus() {
+		if !st.accessible() {
+			return healthcheck.StateCritical, "nok"
+		}
+	}
+
+	return healthcheck.StatePassing, "ok"
+}
+
+func readyPipeline(p *pipeline.Pipeline) func() (healthcheck.State, string) {
+	return func() (healthcheck.State, string) {
+		if !components(p).accessible() {
+			return healthcheck.StateCritical, "nok"
+		}
+
 		return healthcheck.StatePassing, "ok"
 	}
+}
+
+func status() (healthcheck.State, string) {
+	sts := pipelinesStatus()
+
+	state := healthcheck.StatePassing
+	for _, st := range sts {
+		if !st.accessible() {
+			state = healthcheck.StateWarning
+		}
+	}
+
+	return statusBody(state, sts)
+}
+
+func statusPipeline(p *pipeline.Pipeline) func() (healthcheck.State, string) {
+	return func() (healthcheck.State, string) {
+		st := components(p)
+
+		state := healthcheck.StatePassing
+		if !st.accessible() {
+			state = healthcheck.StateWarning
+		}
+
+		return statusBody(state, st)
+	}
+}
+
+func statusBody(state healthcheck.State, v interface{}) (healthcheck.State, string) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return healthcheck.StateCritical, err.Error()
+	}
+
+	// Text is used by healthcheck as format
+	return state, strings.Replace(string(body), "%", "%%", -1)
+}
+
+func limits() (healthcheck.State, string) {
+	var text string
+
+	for _, p := range pipeline.GetPipelines() {
+		l := p.Writer.Limits()
+
+		text += fmt.Sprintf(
+			"[%s]\nqueries: %d\nbytes: %d\nqueries_hits: %d\nbatch_bytes_hits: %d\nbytes_hits: %d\n",
+			p.Name, l.Queries, l.Bytes, l.QueriesHits, l.BatchBytesHits, l.BytesHits,
+		)
+	}
 
-	return healthcheck.StateWarning, "nok"
+	return healthcheck.StatePassing, text
 }
@@ -0,0 +1,175 @@
+package message
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// Compression algorithms, used as AMQP ContentEncoding
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+	EncodingLZ4  = "lz4"
+)
+
+// DefaultMaxSize is default limit of decompressed body size in bytes
+const DefaultMaxSize = 64 << 20
+
+// zstd encoder and decoders are shared, they are safe for concurrent use.
+// Decoders are created per decompressed size limit.
+var (
+	zstdEncoder  *zstd.Encoder
+	zstdOnce     sync.Once
+	zstdDecoders = make(map[int]*zstd.Decoder)
+	zstdM        sync.Mutex
+)
+
+// EncodeCompressed encodes message to JSON and compresses it. Publish it with
+// algorithm as AMQP ContentEncoding.
+func (m Message) EncodeCompressed(algo string) ([]byte, error) {
+	body, err := m.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	return Compress(algo, body)
+}
+
+// Compress compresses body with algorithm. Body is returned as is for empty
+// algorithm or "identity".
+func Compress(algo string, body []byte) ([]byte, error) {
+	switch algo {
+	case "", "identity":
+		return body, nil
+	case EncodingGzip:
+		var buf bytes.Buffer
+
+		w := gzip.NewWriter(&buf)
+
+		_, err := w.Write(body)
+		if err != nil {
+			return nil, err
+		}
+
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	case EncodingZstd:
+		zstdOnce.Do(initZstd)
+		return zstdEncoder.EncodeAll(body, nil), nil
+	case EncodingLZ4:
+		var buf bytes.Buffer
+
+		w := lz4.NewWriter(&buf)
+
+		_, err := w.Write(body)
+		if err != nil {
+			return nil, err
+		}
+
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	return nil, fmt.Errorf("compression %q is not supported", algo)
+}
+
+// Decompress decompresses body, compressed with algorithm. Body is returned as
+// is for empty algorithm or "identity". Decompression fails, if body is larger
+// than maxSize bytes after decompression, 0 - no limit.
+func Decompress(algo string, body []byte, maxSize int) ([]byte, error) {
+	var decompressed []byte
+	var err error
+
+	switch algo {
+	case "", "identity":
+		return body, nil
+	case EncodingGzip:
+		var r *gzip.Reader
+
+		r, err = gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		defer r.Close()
+
+		decompressed, err = readLimited(r, maxSize)
+	case EncodingZstd:
+		decompressed, err = zstdDecoder(maxSize).DecodeAll(body, nil)
+		// Window of frame, larger than limit, needs more memory than limit
+		if err == zstd.ErrDecoderSizeExceeded || err == zstd.ErrWindowSizeExceeded {
+			return nil, errTooLarge(maxSize)
+		}
+	case EncodingLZ4:
+		decompressed, err = readLimited(lz4.NewReader(bytes.NewReader(body)), maxSize)
+	default:
+		return nil, fmt.Errorf("compression %q is not supported", algo)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// zstd checks limit per block, so body can be slightly larger
+	if maxSize > 0 && len(decompressed) > maxSize {
+		return nil, errTooLarge(maxSize)
+	}
+
+	return decompressed, nil
+}
+
+// readLimited reads not more than one byte over maxSize, so too large body
+// is detected without reading it fully
+func readLimited(r io.Reader, maxSize int) ([]byte, error) {
+	if maxSize > 0 {
+		r = io.LimitReader(r, int64(maxSize)+1)
+	}
+
+	return ioutil.ReadAll(r)
+}
+
+func errTooLarge(maxSize int) error {
+	return fmt.Errorf("decompressed body is larger than %d bytes", maxSize)
+}
+
+func initZstd() {
+	// Options are valid, so errors are not possible
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithZeroFrames(true))
+}
+
+// zstdDecoder returns shared decoder with decompressed size limit
+func zstdDecoder(maxSize int) *zstd.Decoder {
+	zstdM.Lock()
+	defer zstdM.Unlock()
+
+	d, ok := zstdDecoders[maxSize]
+	if ok {
+		return d
+	}
+
+	opts := []zstd.DOption{}
+	if maxSize > 0 {
+		opts = append(opts, zstd.WithDecoderMaxMemory(uint64(maxSize)))
+	}
+
+	// Options are valid, so errors are not possible
+	d, _ = zstd.NewReader(nil, opts...)
+	zstdDecoders[maxSize] = d
+
+	return d
+}
@@ -69,6 +69,13 @@ Usage example
 			panic(err)
 		}
 
+		// Or version 2 message with named columns, Corrie builds query itself
+		//
+		//	body, err := message.Message{
+		//		Table:   "default.test",
+		//		Columns: map[string]interface{}{"some_field": 1},
+		//	}.Encode()
+
 		producer.Send(
 			nanachi.Publishing{
 				RoutingKey: queueName,
@@ -1,16 +1,180 @@
 package message
 
-import jsoniter "github.com/json-iterator/go"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+)
 
 var decoder = jsoniter.Config{UseNumber: true}.Froze()
 
-// Message structure
+// Maximum nesting of arrays and maps in MessagePack and Protobuf messages
+const maxDepth = 64
+
+var tableRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// Column name, like "name" or column of nested structure "nested.name"
+var columnRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)*$`)
+
+// Message versions
+const (
+	// Query with positional data
+	V1 = 1
+	// Table with named columns
+	V2 = 2
+)
+
+// Message structure. Version 1 message holds Query and Data or, for multiple
+// rows, Rows. Version 2 message holds Table and Columns.
 type Message struct {
+	Query   string
+	Data    []interface{}
+	Rows    [][]interface{}
+	Table   string
+	Columns map[string]interface{}
+}
+
+type messageV1 struct {
 	Query string
-	Data  []interface{}
+	Data  []interface{}   `json:",omitempty"`
+	Rows  [][]interface{} `json:",omitempty"`
+}
+
+type messageV2 struct {
+	Table   string
+	Columns map[string]interface{}
 }
 
-// Encode message
+// Content types of encoded messages
+const (
+	ContentTypeJSON    = "application/json"
+	ContentTypeMsgpack = "application/msgpack"
+	ContentTypeProto   = "application/protobuf"
+)
+
+// Encode message. Only fields of message version are encoded.
 func (m Message) Encode() ([]byte, error) {
-	return decoder.Marshal(m)
+	if m.Version() == V2 {
+		// Vendored jsoniter fails to encode maps with recent Go versions
+		return json.Marshal(messageV2{Table: m.Table, Columns: m.Columns})
+	}
+
+	return decoder.Marshal(messageV1{Query: m.Query, Data: m.Data, Rows: m.Rows})
+}
+
+// Decode message. Numbers are decoded as json.Number.
+func Decode(body []byte) (Message, error) {
+	var m Message
+	err := decoder.Unmarshal(body, &m)
+	return m, err
+}
+
+// EncodeContent encodes message according to AMQP content type. Messages of
+// other content types are encoded as JSON.
+func (m Message) EncodeContent(contentType string) ([]byte, error) {
+	switch mediaType(contentType) {
+	case ContentTypeMsgpack, "application/x-msgpack":
+		return m.EncodeMsgpack()
+	case ContentTypeProto, "application/x-protobuf":
+		return m.EncodeProto()
+	}
+
+	return m.Encode()
+}
+
+// DecodeContent decodes message according to AMQP content type. Messages of
+// other content types are decoded as JSON.
+func DecodeContent(contentType string, body []byte) (Message, error) {
+	switch mediaType(contentType) {
+	case ContentTypeMsgpack, "application/x-msgpack":
+		return DecodeMsgpack(body)
+	case ContentTypeProto, "application/x-protobuf":
+		return DecodeProto(body)
+	}
+
+	return Decode(body)
+}
+
+// mediaType strips parameters of content type
+func mediaType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+
+	return strings.TrimSpace(contentType)
+}
+
+// Version detects message version by its fields
+func (m Message) Version() int {
+	if m.Table != "" {
+		return V2
+	}
+
+	return V1
+}
+
+// Split returns message with Data for every row of multi-row message. Single
+// row message is returned as is.
+func (m Message) Split() []Message {
+	if m.Rows == nil {
+		return []Message{m}
+	}
+
+	msgs := make([]Message, len(m.Rows))
+
+	for i, row := range m.Rows {
+		msgs[i] = Message{Query: m.Query, Data: row}
+	}
+
+	return msgs
+}
+
+// ToV1 converts version 2 message to version 1 message. Query is built with
+// columns in sorted order, so messages to one table with the same set of
+// columns get the same query. Version 1 message is returned as is.
+func (m Message) ToV1() (Message, error) {
+	if m.Version() == V1 {
+		return m, nil
+	}
+
+	if !tableRe.MatchString(m.Table) {
+		return Message{}, fmt.Errorf("invalid table name %q", m.Table)
+	}
+
+	if len(m.Columns) == 0 {
+		return Message{}, errors.New("no columns")
+	}
+
+	names := make([]string, 0, len(m.Columns))
+
+	for name := range m.Columns {
+		if !columnRe.MatchString(name) {
+			return Message{}, fmt.Errorf("invalid column name %q", name)
+		}
+
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	quoted := make([]string, len(names))
+	data := make([]interface{}, len(names))
+
+	for i, name := range names {
+		quoted[i] = "`" + name + "`"
+		data[i] = m.Columns[name]
+	}
+
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (%s)",
+		m.Table, strings.Join(quoted, ", "),
+		strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", "),
+	)
+
+	return Message{Query: query, Data: data}, nil
 }
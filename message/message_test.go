@@ -0,0 +1,634 @@
+package message
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMsgpackValues(t *testing.T) {
+	tests := []struct {
+		name string
+		in   interface{}
+		out  interface{}
+	}{
+		{"nil", nil, nil},
+		{"bool", true, true},
+		{"positive fixint", int64(127), int64(127)},
+		{"negative fixint", int64(-1), int64(-1)},
+		{"negative fixint min", int64(-32), int64(-32)},
+		{"int8", int64(-33), int64(-33)},
+		{"int16", int64(math.MinInt16), int64(math.MinInt16)},
+		{"int32", int64(math.MinInt32), int64(math.MinInt32)},
+		{"int64 min", int64(math.MinInt64), int64(math.MinInt64)},
+		{"int64 max", int64(math.MaxInt64), int64(math.MaxInt64)},
+		{"uint8", uint8(200), int64(200)},
+		{"uint32 max", uint32(math.MaxUint32), int64(math.MaxUint32)},
+		{"uint64 over int64", uint64(math.MaxInt64) + 1, uint64(math.MaxInt64) + 1},
+		{"uint64 max", uint64(math.MaxUint64), uint64(math.MaxUint64)},
+		{"number int", json.Number("-5"), int64(-5)},
+		{"number uint64", json.Number("18446744073709551615"), uint64(math.MaxUint64)},
+		{"number float", json.Number("1.5"), 1.5},
+		{"float32", float32(1.5), 1.5},
+		{"float64", math.MaxFloat64, math.MaxFloat64},
+		{"fixstr", "abc", "abc"},
+		{"str16", strings.Repeat("a", 300), strings.Repeat("a", 300)},
+		{"binary", []byte{1, 2, 3}, []byte{1, 2, 3}},
+		{"time", time.Unix(-1, 5).UTC(), time.Unix(-1, 5).UTC()},
+		{"array", []interface{}{int64(1), "a", nil}, []interface{}{int64(1), "a", nil}},
+		{"map", map[string]interface{}{"a": int64(1)}, map[string]interface{}{"a": int64(1)}},
+	}
+
+	for _, tt := range tests {
+		buf, err := appendMsgpack(nil, tt.in)
+		if err != nil {
+			t.Errorf("%s: encode failed: %v", tt.name, err)
+			continue
+		}
+
+		d := &msgpackDecoder{buf: buf}
+
+		v, err := d.decode()
+		if err != nil {
+			t.Errorf("%s: decode failed: %v", tt.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(v, tt.out) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, v, tt.out)
+		}
+
+		if d.pos != len(buf) {
+			t.Errorf("%s: %d of %d bytes decoded", tt.name, d.pos, len(buf))
+		}
+	}
+}
+
+func TestMsgpackIntEncoding(t *testing.T) {
+	tests := []struct {
+		in  int64
+		out []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0xcc, 0x80}},
+		{-1, []byte{0xff}},
+		{-32, []byte{0xe0}},
+		{-33, []byte{0xd0, 0xdf}},
+		{math.MinInt8, []byte{0xd0, 0x80}},
+		{math.MinInt8 - 1, []byte{0xd1, 0xff, 0x7f}},
+		{math.MinInt64, []byte{0xd3, 0x80, 0, 0, 0, 0, 0, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		buf := appendMsgpackInt(nil, tt.in)
+
+		if !bytes.Equal(buf, tt.out) {
+			t.Errorf("%d: got % x, want % x", tt.in, buf, tt.out)
+		}
+	}
+}
+
+func TestMsgpackTimestamp(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		out  time.Time
+		err  bool
+	}{
+		{
+			name: "timestamp 32",
+			in:   []byte{0xd6, 0xff, 0, 0, 0, 1},
+			out:  time.Unix(1, 0).UTC(),
+		},
+		{
+			name: "timestamp 64",
+			// 5 nanoseconds in upper 30 bits, 1 second in lower 34 bits
+			in:  []byte{0xd7, 0xff, 0, 0, 0, 0x14, 0, 0, 0, 1},
+			out: time.Unix(1, 5).UTC(),
+		},
+		{
+			name: "timestamp 96",
+			in:   []byte{0xc7, 12, 0xff, 0, 0, 0, 5, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			out:  time.Unix(-1, 5).UTC(),
+		},
+		{
+			name: "invalid size",
+			in:   []byte{0xd5, 0xff, 0, 1},
+			err:  true,
+		},
+		{
+			name: "unsupported extension",
+			in:   []byte{0xd6, 1, 0, 0, 0, 1},
+			err:  true,
+		},
+		{
+			name: "truncated",
+			in:   []byte{0xc7, 12, 0xff, 0, 0, 0, 5},
+			err:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		v, err := (&msgpackDecoder{buf: tt.in}).decode()
+
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected error, got %v", tt.name, v)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: decode failed: %v", tt.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(v, tt.out) {
+			t.Errorf("%s: got %v, want %v", tt.name, v, tt.out)
+		}
+	}
+}
+
+func TestMsgpackDepth(t *testing.T) {
+	tests := []struct {
+		name  string
+		depth int
+		err   error
+	}{
+		{"limit", maxDepth, nil},
+		{"over limit", maxDepth + 1, errMsgpackDepth},
+		{"stack overflow", 1 << 20, errMsgpackDepth},
+	}
+
+	for _, tt := range tests {
+		buf := append(bytes.Repeat([]byte{0x91}, tt.depth), 0xc0)
+
+		_, err := (&msgpackDecoder{buf: buf}).decode()
+		if err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestProtoDepth(t *testing.T) {
+	tests := []struct {
+		name  string
+		depth int
+		err   error
+	}{
+		{"limit", maxDepth, nil},
+		{"over limit", maxDepth + 1, errProtoDepth},
+	}
+
+	for _, tt := range tests {
+		var v interface{}
+
+		for i := 0; i < tt.depth; i++ {
+			v = []interface{}{v}
+		}
+
+		body, err := Message{Query: "q", Data: []interface{}{v}}.EncodeProto()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = DecodeProto(body)
+		if err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+// testMessages are decoded to the same messages by MessagePack and Protobuf
+var testMessages = []struct {
+	name string
+	msg  Message
+}{
+	{
+		name: "data",
+		msg: Message{
+			Query: "INSERT INTO t (a, b, c, d, e) VALUES (?, ?, ?, ?, ?)",
+			Data: []interface{}{
+				int64(math.MinInt64), uint64(math.MaxUint64), "x", 1.5, time.Unix(1, 5).UTC(),
+			},
+		},
+	},
+	{
+		name: "rows",
+		msg: Message{
+			Query: "INSERT INTO t (a, b) VALUES (?, ?)",
+			Rows: [][]interface{}{
+				{int64(-1), []byte{1}},
+				{int64(math.MaxInt64), nil},
+			},
+		},
+	},
+	{
+		name: "columns",
+		msg: Message{
+			Table: "db.t",
+			Columns: map[string]interface{}{
+				"a": int64(-32),
+				"b": "x",
+				"c": nil,
+				"d": []interface{}{int64(1), int64(2)},
+				"e": true,
+			},
+		},
+	},
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	for _, tt := range testMessages {
+		body, err := tt.msg.EncodeMsgpack()
+		if err != nil {
+			t.Errorf("%s: encode failed: %v", tt.name, err)
+			continue
+		}
+
+		m, err := DecodeMsgpack(body)
+		if err != nil {
+			t.Errorf("%s: decode failed: %v", tt.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(m, tt.msg) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, m, tt.msg)
+		}
+
+		// Every prefix of message is incomplete
+		for i := 0; i < len(body); i++ {
+			_, err = DecodeMsgpack(body[:i])
+			if err == nil {
+				t.Errorf("%s: no error for %d of %d bytes", tt.name, i, len(body))
+				break
+			}
+		}
+
+		_, err = DecodeMsgpack(append(body, 0xc0))
+		if err == nil {
+			t.Errorf("%s: no error for extra data", tt.name)
+		}
+	}
+}
+
+func TestProtoRoundTrip(t *testing.T) {
+	for _, tt := range testMessages {
+		body, err := tt.msg.EncodeProto()
+		if err != nil {
+			t.Errorf("%s: encode failed: %v", tt.name, err)
+			continue
+		}
+
+		m, err := DecodeProto(body)
+		if err != nil {
+			t.Errorf("%s: decode failed: %v", tt.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(m, tt.msg) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, m, tt.msg)
+		}
+
+		// Last field is cut in the middle
+		_, err = DecodeProto(body[:len(body)-1])
+		if err != errProtoShort {
+			t.Errorf("%s: got error %v for truncated message", tt.name, err)
+		}
+	}
+}
+
+func TestProtoValues(t *testing.T) {
+	tests := []struct {
+		name string
+		in   interface{}
+		out  interface{}
+	}{
+		{"negative", int64(-1), int64(-1)},
+		{"int64 min", int64(math.MinInt64), int64(math.MinInt64)},
+		{"int64 max", int64(math.MaxInt64), int64(math.MaxInt64)},
+		{"uint8", uint8(200), uint64(200)},
+		{"uint64 max", uint64(math.MaxUint64), uint64(math.MaxUint64)},
+		{"number int", json.Number("-5"), int64(-5)},
+		{"number uint64", json.Number("18446744073709551615"), uint64(math.MaxUint64)},
+		{"number float", json.Number("1.5"), 1.5},
+		{"float32", float32(1.5), 1.5},
+		{"time before epoch", time.Unix(-1, 5).UTC(), time.Unix(-1, 5).UTC()},
+		{"empty array", []interface{}{}, []interface{}{}},
+	}
+
+	for _, tt := range tests {
+		body, err := Message{Query: "q", Data: []interface{}{tt.in}}.EncodeProto()
+		if err != nil {
+			t.Errorf("%s: encode failed: %v", tt.name, err)
+			continue
+		}
+
+		m, err := DecodeProto(body)
+		if err != nil {
+			t.Errorf("%s: decode failed: %v", tt.name, err)
+			continue
+		}
+
+		if len(m.Data) != 1 || !reflect.DeepEqual(m.Data[0], tt.out) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, m.Data, tt.out)
+		}
+	}
+}
+
+func benchmarkMessage() Message {
+	return Message{
+		Query: "INSERT INTO db.events (id, user, name, value, ratio, created) VALUES (?, ?, ?, ?, ?, ?)",
+		Data: []interface{}{
+			int64(1234567890), uint64(math.MaxUint64), "event name", int64(-42), 0.5, "2018-01-01 00:00:00",
+		},
+	}
+}
+
+func BenchmarkDecodeJSON(b *testing.B) {
+	body, err := benchmarkMessage().Encode()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err = Decode(body)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeMsgpack(b *testing.B) {
+	body, err := benchmarkMessage().EncodeMsgpack()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err = DecodeMsgpack(body)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeProto(b *testing.B) {
+	body, err := benchmarkMessage().EncodeProto()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err = DecodeProto(body)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	body := []byte(strings.Repeat(`{"Query": "INSERT INTO t (a) VALUES (?)", "Data": [1]}`, 100))
+
+	tests := []struct {
+		algo string
+		body []byte
+	}{
+		{"", body},
+		{"identity", body},
+		{EncodingGzip, body},
+		{EncodingZstd, body},
+		{EncodingZstd, []byte{}},
+		{EncodingLZ4, body},
+		{EncodingLZ4, []byte{}},
+	}
+
+	for _, tt := range tests {
+		compressed, err := Compress(tt.algo, tt.body)
+		if err != nil {
+			t.Errorf("%q: compress failed: %v", tt.algo, err)
+			continue
+		}
+
+		if tt.algo != "" && tt.algo != "identity" && len(tt.body) > 0 && len(compressed) >= len(tt.body) {
+			t.Errorf("%q: body is not compressed", tt.algo)
+		}
+
+		decompressed, err := Decompress(tt.algo, compressed, DefaultMaxSize)
+		if err != nil {
+			t.Errorf("%q: decompress failed: %v", tt.algo, err)
+			continue
+		}
+
+		if !bytes.Equal(decompressed, tt.body) {
+			t.Errorf("%q: got %q", tt.algo, decompressed)
+		}
+	}
+}
+
+func TestDecompressErrors(t *testing.T) {
+	tests := []struct {
+		algo string
+		body []byte
+	}{
+		{EncodingGzip, []byte("not compressed")},
+		{EncodingZstd, []byte("not compressed")},
+		{EncodingLZ4, []byte("not compressed")},
+		{"br", []byte("not compressed")},
+	}
+
+	for _, tt := range tests {
+		_, err := Decompress(tt.algo, tt.body, DefaultMaxSize)
+		if err == nil {
+			t.Errorf("%q: expected error", tt.algo)
+		}
+	}
+
+	_, err := Compress("br", []byte("body"))
+	if err == nil {
+		t.Error("expected error for unknown compression")
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	// Highly compressible body, like decompression bomb
+	body := make([]byte, 4<<20)
+
+	for _, algo := range []string{EncodingGzip, EncodingZstd, EncodingLZ4} {
+		compressed, err := Compress(algo, body)
+		if err != nil {
+			t.Fatalf("%q: %v", algo, err)
+		}
+
+		_, err = Decompress(algo, compressed, 1<<20)
+		if err == nil || !strings.Contains(err.Error(), "larger than") {
+			t.Errorf("%q: expected size limit error, got %v", algo, err)
+		}
+
+		decompressed, err := Decompress(algo, compressed, len(body))
+		if err != nil {
+			t.Errorf("%q: body of limit size: %v", algo, err)
+		} else if len(decompressed) != len(body) {
+			t.Errorf("%q: got %d bytes, want %d", algo, len(decompressed), len(body))
+		}
+
+		_, err = Decompress(algo, compressed, 0)
+		if err != nil {
+			t.Errorf("%q: without limit: %v", algo, err)
+		}
+	}
+}
+
+func TestEncodeCompressed(t *testing.T) {
+	msg := Message{Query: "INSERT INTO t (a) VALUES (?)", Data: []interface{}{json.Number("1")}}
+
+	for _, algo := range []string{EncodingGzip, EncodingZstd, EncodingLZ4} {
+		body, err := msg.EncodeCompressed(algo)
+		if err != nil {
+			t.Errorf("%q: encode failed: %v", algo, err)
+			continue
+		}
+
+		body, err = Decompress(algo, body, DefaultMaxSize)
+		if err != nil {
+			t.Errorf("%q: decompress failed: %v", algo, err)
+			continue
+		}
+
+		m, err := Decode(body)
+		if err != nil {
+			t.Errorf("%q: decode failed: %v", algo, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(m, msg) {
+			t.Errorf("%q: got %#v, want %#v", algo, m, msg)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+		out  []Message
+	}{
+		{
+			name: "single row",
+			msg:  Message{Query: "INSERT INTO t (a) VALUES (?)", Data: []interface{}{1}},
+			out:  []Message{{Query: "INSERT INTO t (a) VALUES (?)", Data: []interface{}{1}}},
+		},
+		{
+			name: "rows",
+			msg:  Message{Query: "INSERT INTO t (a) VALUES (?)", Rows: [][]interface{}{{1}, {2}}},
+			out: []Message{
+				{Query: "INSERT INTO t (a) VALUES (?)", Data: []interface{}{1}},
+				{Query: "INSERT INTO t (a) VALUES (?)", Data: []interface{}{2}},
+			},
+		},
+		{
+			name: "no rows",
+			msg:  Message{Query: "INSERT INTO t (a) VALUES (?)", Rows: [][]interface{}{}},
+			out:  []Message{},
+		},
+	}
+
+	for _, tt := range tests {
+		out := tt.msg.Split()
+
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, out, tt.out)
+		}
+	}
+}
+
+func TestToV1(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+		out  Message
+		err  bool
+	}{
+		{
+			name: "version 1",
+			msg:  Message{Query: "INSERT INTO t (a) VALUES (?)", Data: []interface{}{1}},
+			out:  Message{Query: "INSERT INTO t (a) VALUES (?)", Data: []interface{}{1}},
+		},
+		{
+			name: "sorted columns",
+			msg:  Message{Table: "db.t", Columns: map[string]interface{}{"b": 2, "a": 1, "n.c": 3}},
+			out:  Message{Query: "INSERT INTO db.t (`a`, `b`, `n.c`) VALUES (?, ?, ?)", Data: []interface{}{1, 2, 3}},
+		},
+		{
+			name: "invalid table",
+			msg:  Message{Table: "db.t; DROP TABLE db.t", Columns: map[string]interface{}{"a": 1}},
+			err:  true,
+		},
+		{
+			name: "quoted table",
+			msg:  Message{Table: "`db`.`t`", Columns: map[string]interface{}{"a": 1}},
+			err:  true,
+		},
+		{
+			name: "invalid column",
+			msg:  Message{Table: "t", Columns: map[string]interface{}{"a`": 1}},
+			err:  true,
+		},
+		{
+			name: "escaping column",
+			msg:  Message{Table: "t", Columns: map[string]interface{}{"a\\": 1, "b) SELECT * FROM secret.users --": 2}},
+			err:  true,
+		},
+		{
+			name: "column with space",
+			msg:  Message{Table: "t", Columns: map[string]interface{}{"c d": 1}},
+			err:  true,
+		},
+		{
+			name: "empty column",
+			msg:  Message{Table: "t", Columns: map[string]interface{}{"": 1}},
+			err:  true,
+		},
+		{
+			name: "no columns",
+			msg:  Message{Table: "t"},
+			err:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		out, err := tt.msg.ToV1()
+
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected error, got %+v", tt.name, out)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, out, tt.out)
+		}
+	}
+}
@@ -0,0 +1,630 @@
+package message
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Extension type of MessagePack timestamp
+const msgpackTimestamp = -1
+
+// EncodeMsgpack encodes message to MessagePack. Message is encoded as map with
+// the same keys, as in JSON.
+func (m Message) EncodeMsgpack() ([]byte, error) {
+	fields := m.fields()
+
+	buf := appendMsgpackMapHeader(nil, len(fields))
+
+	var err error
+
+	for _, f := range fields {
+		buf = appendMsgpackString(buf, f.name)
+
+		buf, err = appendMsgpack(buf, f.value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.name, err)
+		}
+	}
+
+	return buf, nil
+}
+
+// DecodeMsgpack decodes message from MessagePack. Integers are decoded as
+// int64 or, if they don't fit, uint64, floats as float64, binary strings as
+// []byte and timestamps as time.Time.
+func DecodeMsgpack(body []byte) (Message, error) {
+	d := &msgpackDecoder{buf: body}
+
+	v, err := d.decode()
+	if err != nil {
+		return Message{}, err
+	}
+
+	if d.pos != len(d.buf) {
+		return Message{}, errors.New("msgpack: extra data after message")
+	}
+
+	return fromMap(v)
+}
+
+type field struct {
+	name  string
+	value interface{}
+}
+
+// fields returns not empty fields of message version
+func (m Message) fields() []field {
+	if m.Version() == V2 {
+		return []field{{"Table", m.Table}, {"Columns", m.Columns}}
+	}
+
+	fields := []field{{"Query", m.Query}}
+
+	if m.Data != nil {
+		fields = append(fields, field{"Data", m.Data})
+	}
+
+	if m.Rows != nil {
+		rows := make([]interface{}, len(m.Rows))
+		for i, row := range m.Rows {
+			rows[i] = row
+		}
+
+		fields = append(fields, field{"Rows", rows})
+	}
+
+	return fields
+}
+
+// fromMap builds message from decoded map
+func fromMap(v interface{}) (Message, error) {
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		return Message{}, fmt.Errorf("expected map, got %T", v)
+	}
+
+	var m Message
+	var err error
+
+	for name, val := range fields {
+		switch name {
+		case "Query":
+			m.Query, ok = val.(string)
+		case "Table":
+			m.Table, ok = val.(string)
+		case "Data":
+			m.Data, ok = val.([]interface{})
+		case "Columns":
+			m.Columns, ok = val.(map[string]interface{})
+		case "Rows":
+			m.Rows, err = toRows(val)
+			ok = err == nil
+		default:
+			continue
+		}
+
+		if !ok && val != nil {
+			return Message{}, fmt.Errorf("invalid type %T of %s", val, name)
+		}
+	}
+
+	return m, nil
+}
+
+func toRows(v interface{}) ([][]interface{}, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected array, got %T", v)
+	}
+
+	rows := make([][]interface{}, len(list))
+
+	for i, item := range list {
+		row, ok := item.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected array, got %T", item)
+		}
+
+		rows[i] = row
+	}
+
+	return rows, nil
+}
+
+func appendMsgpack(buf []byte, v interface{}) ([]byte, error) {
+	switch val := v.(type) {
+	case nil:
+		return append(buf, 0xc0), nil
+	case bool:
+		if val {
+			return append(buf, 0xc3), nil
+		}
+
+		return append(buf, 0xc2), nil
+	case int:
+		return appendMsgpackInt(buf, int64(val)), nil
+	case int8:
+		return appendMsgpackInt(buf, int64(val)), nil
+	case int16:
+		return appendMsgpackInt(buf, int64(val)), nil
+	case int32:
+		return appendMsgpackInt(buf, int64(val)), nil
+	case int64:
+		return appendMsgpackInt(buf, val), nil
+	case uint:
+		return appendMsgpackUint(buf, uint64(val)), nil
+	case uint8:
+		return appendMsgpackUint(buf, uint64(val)), nil
+	case uint16:
+		return appendMsgpackUint(buf, uint64(val)), nil
+	case uint32:
+		return appendMsgpackUint(buf, uint64(val)), nil
+	case uint64:
+		return appendMsgpackUint(buf, val), nil
+	case float32:
+		buf = append(buf, 0xca)
+		return appendUint32(buf, math.Float32bits(val)), nil
+	case float64:
+		buf = append(buf, 0xcb)
+		return appendUint64(buf, math.Float64bits(val)), nil
+	case json.Number:
+		return appendMsgpackNumber(buf, val)
+	case string:
+		return appendMsgpackString(buf, val), nil
+	case []byte:
+		return appendMsgpackBinary(buf, val), nil
+	case time.Time:
+		return appendMsgpackTime(buf, val), nil
+	case []interface{}:
+		buf = appendMsgpackArrayHeader(buf, len(val))
+
+		var err error
+
+		for _, item := range val {
+			buf, err = appendMsgpack(buf, item)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return buf, nil
+	case map[string]interface{}:
+		buf = appendMsgpackMapHeader(buf, len(val))
+
+		var err error
+
+		for k, item := range val {
+			buf = appendMsgpackString(buf, k)
+
+			buf, err = appendMsgpack(buf, item)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return buf, nil
+	}
+
+	return nil, fmt.Errorf("unsupported type %T", v)
+}
+
+func appendMsgpackInt(buf []byte, n int64) []byte {
+	if n >= 0 {
+		return appendMsgpackUint(buf, uint64(n))
+	}
+
+	switch {
+	case n >= -32:
+		return append(buf, byte(n))
+	case n >= math.MinInt8:
+		return append(buf, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		buf = append(buf, 0xd1)
+		return appendUint16(buf, uint16(n))
+	case n >= math.MinInt32:
+		buf = append(buf, 0xd2)
+		return appendUint32(buf, uint32(n))
+	}
+
+	buf = append(buf, 0xd3)
+
+	return appendUint64(buf, uint64(n))
+}
+
+func appendMsgpackUint(buf []byte, n uint64) []byte {
+	switch {
+	case n <= 0x7f:
+		return append(buf, byte(n))
+	case n <= math.MaxUint8:
+		return append(buf, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		buf = append(buf, 0xcd)
+		return appendUint16(buf, uint16(n))
+	case n <= math.MaxUint32:
+		buf = append(buf, 0xce)
+		return appendUint32(buf, uint32(n))
+	}
+
+	buf = append(buf, 0xcf)
+
+	return appendUint64(buf, n)
+}
+
+// appendMsgpackNumber encodes JSON number as integer, if it is integer,
+// otherwise as float
+func appendMsgpackNumber(buf []byte, num json.Number) ([]byte, error) {
+	i, err := strconv.ParseInt(string(num), 10, 64)
+	if err == nil {
+		return appendMsgpackInt(buf, i), nil
+	}
+
+	u, err := strconv.ParseUint(string(num), 10, 64)
+	if err == nil {
+		return appendMsgpackUint(buf, u), nil
+	}
+
+	f, err := num.Float64()
+	if err != nil {
+		return nil, err
+	}
+
+	return appendMsgpack(buf, f)
+}
+
+func appendMsgpackString(buf []byte, s string) []byte {
+	n := len(s)
+
+	switch {
+	case n <= 31:
+		buf = append(buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		buf = append(buf, 0xda)
+		buf = appendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, 0xdb)
+		buf = appendUint32(buf, uint32(n))
+	}
+
+	return append(buf, s...)
+}
+
+func appendMsgpackBinary(buf []byte, b []byte) []byte {
+	n := len(b)
+
+	switch {
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		buf = append(buf, 0xc5)
+		buf = appendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, 0xc6)
+		buf = appendUint32(buf, uint32(n))
+	}
+
+	return append(buf, b...)
+}
+
+// appendMsgpackTime encodes time as timestamp 96 extension
+func appendMsgpackTime(buf []byte, tm time.Time) []byte {
+	buf = append(buf, 0xc7, 12, 0xff)
+	buf = appendUint32(buf, uint32(tm.Nanosecond()))
+
+	return appendUint64(buf, uint64(tm.Unix()))
+}
+
+func appendMsgpackArrayHeader(buf []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(buf, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		buf = append(buf, 0xdc)
+		return appendUint16(buf, uint16(n))
+	}
+
+	buf = append(buf, 0xdd)
+
+	return appendUint32(buf, uint32(n))
+}
+
+func appendMsgpackMapHeader(buf []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(buf, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		buf = append(buf, 0xde)
+		return appendUint16(buf, uint16(n))
+	}
+
+	buf = append(buf, 0xdf)
+
+	return appendUint32(buf, uint32(n))
+}
+
+type msgpackDecoder struct {
+	buf []byte
+	pos int
+	// Nesting of current array or map
+	depth int
+}
+
+var (
+	errMsgpackShort = errors.New("msgpack: unexpected end of data")
+	errMsgpackDepth = fmt.Errorf("msgpack: nesting is deeper than %d levels", maxDepth)
+)
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.buf)-d.pos < n {
+		return nil, errMsgpackShort
+	}
+
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+
+	return b, nil
+}
+
+// size reads length of n bytes
+func (d *msgpackDecoder) size(n int) (int, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+
+	switch n {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	}
+
+	return int(binary.BigEndian.Uint32(b)), nil
+}
+
+func (d *msgpackDecoder) decode() (interface{}, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+
+	c := b[0]
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.decodeMap(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return d.decodeArray(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return d.decodeString(int(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.size(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+
+		return append([]byte(nil), b...), nil
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.size(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+
+		return d.decodeExt(n)
+	case 0xca:
+		b, err := d.next(4)
+		if err != nil {
+			return nil, err
+		}
+
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case 0xcb:
+		b, err := d.next(8)
+		if err != nil {
+			return nil, err
+		}
+
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		b, err := d.next(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+
+		n := readUint(b)
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+
+		return int64(n), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+
+		b, err := d.next(size)
+		if err != nil {
+			return nil, err
+		}
+
+		// Sign extension
+		shift := uint(64 - size*8)
+
+		return int64(readUint(b)<<shift) >> shift, nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.decodeExt(1 << (c - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.size(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+
+		return d.decodeString(n)
+	case 0xdc, 0xdd:
+		n, err := d.size(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+
+		return d.decodeArray(n)
+	case 0xde, 0xdf:
+		n, err := d.size(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+
+		return d.decodeMap(n)
+	}
+
+	return nil, fmt.Errorf("msgpack: unknown format 0x%x", c)
+}
+
+func readUint(b []byte) uint64 {
+	var n uint64
+
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+
+	return n
+}
+
+func (d *msgpackDecoder) decodeString(n int) (string, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) decodeArray(n int) ([]interface{}, error) {
+	if n > len(d.buf)-d.pos {
+		return nil, errMsgpackShort
+	}
+
+	if d.depth >= maxDepth {
+		return nil, errMsgpackDepth
+	}
+
+	d.depth++
+	defer func() { d.depth-- }()
+
+	arr := make([]interface{}, n)
+
+	for i := range arr {
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+
+		arr[i] = v
+	}
+
+	return arr, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int) (map[string]interface{}, error) {
+	if n > len(d.buf)-d.pos {
+		return nil, errMsgpackShort
+	}
+
+	if d.depth >= maxDepth {
+		return nil, errMsgpackDepth
+	}
+
+	d.depth++
+	defer func() { d.depth-- }()
+
+	m := make(map[string]interface{}, n)
+
+	for i := 0; i < n; i++ {
+		k, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: expected string key, got %T", k)
+		}
+
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+
+		m[key] = v
+	}
+
+	return m, nil
+}
+
+// decodeExt decodes extension with data of n bytes. Only timestamps are
+// supported.
+func (d *msgpackDecoder) decodeExt(n int) (interface{}, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+
+	typ := int8(b[0])
+
+	data, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if typ != msgpackTimestamp {
+		return nil, fmt.Errorf("msgpack: unsupported extension type %d", typ)
+	}
+
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0).UTC(), nil
+	case 8:
+		v := binary.BigEndian.Uint64(data)
+		return time.Unix(int64(v&0x3ffffffff), int64(v>>34)).UTC(), nil
+	case 12:
+		nsec := binary.BigEndian.Uint32(data[:4])
+		sec := int64(binary.BigEndian.Uint64(data[4:]))
+
+		return time.Unix(sec, int64(nsec)).UTC(), nil
+	}
+
+	return nil, fmt.Errorf("msgpack: invalid timestamp size %d", n)
+}
+
+func appendUint16(buf []byte, n uint16) []byte {
+	return append(buf, byte(n>>8), byte(n))
+}
+
+func appendUint32(buf []byte, n uint32) []byte {
+	return append(buf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func appendUint64(buf []byte, n uint64) []byte {
+	return appendUint32(appendUint32(buf, uint32(n>>32)), uint32(n))
+}
@@ -0,0 +1,463 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Field numbers of Value message, see message.proto
+const (
+	protoNull = iota + 1
+	protoBool
+	protoInt
+	protoUint
+	protoFloat
+	protoString
+	protoBytes
+	protoTimestamp
+	protoArray
+)
+
+var (
+	errProtoShort = errors.New("proto: unexpected end of data")
+	errProtoDepth = fmt.Errorf("proto: nesting is deeper than %d levels", maxDepth)
+)
+
+// EncodeProto encodes message to Protobuf according to message.proto schema
+func (m Message) EncodeProto() ([]byte, error) {
+	var buf []byte
+	var err error
+
+	if m.Version() == V2 {
+		buf = appendProtoString(buf, 4, m.Table)
+
+		// Sorted to get the same encoding for the same message
+		names := make([]string, 0, len(m.Columns))
+		for name := range m.Columns {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			entry := appendProtoString(nil, 1, name)
+
+			entry, err = appendProtoValue(entry, 2, m.Columns[name])
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %v", name, err)
+			}
+
+			buf = appendProtoBytes(buf, 5, entry)
+		}
+
+		return buf, nil
+	}
+
+	buf = appendProtoString(buf, 1, m.Query)
+
+	for _, v := range m.Data {
+		buf, err = appendProtoValue(buf, 2, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, row := range m.Rows {
+		encoded, err := encodeProtoRow(row)
+		if err != nil {
+			return nil, err
+		}
+
+		buf = appendProtoBytes(buf, 3, encoded)
+	}
+
+	return buf, nil
+}
+
+// DecodeProto decodes message from Protobuf. Values are decoded to the same
+// types, as with DecodeMsgpack.
+func DecodeProto(body []byte) (Message, error) {
+	var m Message
+
+	err := walkProto(body, func(num int, wire int, data []byte, _ uint64) error {
+		switch {
+		case num == 1 && wire == wireBytes:
+			m.Query = string(data)
+		case num == 2 && wire == wireBytes:
+			v, err := decodeProtoValue(data, 0)
+			if err != nil {
+				return err
+			}
+
+			m.Data = append(m.Data, v)
+		case num == 3 && wire == wireBytes:
+			row, err := decodeProtoRow(data, 1)
+			if err != nil {
+				return err
+			}
+
+			m.Rows = append(m.Rows, row)
+		case num == 4 && wire == wireBytes:
+			m.Table = string(data)
+		case num == 5 && wire == wireBytes:
+			name, v, err := decodeProtoEntry(data)
+			if err != nil {
+				return err
+			}
+
+			if m.Columns == nil {
+				m.Columns = make(map[string]interface{})
+			}
+
+			m.Columns[name] = v
+		}
+
+		return nil
+	})
+
+	return m, err
+}
+
+func encodeProtoRow(row []interface{}) ([]byte, error) {
+	var buf []byte
+	var err error
+
+	for _, v := range row {
+		buf, err = appendProtoValue(buf, 1, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buf, nil
+}
+
+// appendProtoValue appends Value message as field num
+func appendProtoValue(buf []byte, num int, v interface{}) ([]byte, error) {
+	var val []byte
+
+	switch v := v.(type) {
+	case nil:
+		val = appendProtoVarint(val, protoNull, 1)
+	case bool:
+		var b uint64
+		if v {
+			b = 1
+		}
+
+		val = appendProtoVarint(val, protoBool, b)
+	case int:
+		val = appendProtoVarint(val, protoInt, zigzag(int64(v)))
+	case int8:
+		val = appendProtoVarint(val, protoInt, zigzag(int64(v)))
+	case int16:
+		val = appendProtoVarint(val, protoInt, zigzag(int64(v)))
+	case int32:
+		val = appendProtoVarint(val, protoInt, zigzag(int64(v)))
+	case int64:
+		val = appendProtoVarint(val, protoInt, zigzag(v))
+	case uint:
+		val = appendProtoVarint(val, protoUint, uint64(v))
+	case uint8:
+		val = appendProtoVarint(val, protoUint, uint64(v))
+	case uint16:
+		val = appendProtoVarint(val, protoUint, uint64(v))
+	case uint32:
+		val = appendProtoVarint(val, protoUint, uint64(v))
+	case uint64:
+		val = appendProtoVarint(val, protoUint, v)
+	case float32:
+		val = appendProtoFixed64(val, protoFloat, math.Float64bits(float64(v)))
+	case float64:
+		val = appendProtoFixed64(val, protoFloat, math.Float64bits(v))
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			val = appendProtoVarint(val, protoInt, zigzag(i))
+		} else if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			val = appendProtoVarint(val, protoUint, u)
+		} else {
+			f, err := v.Float64()
+			if err != nil {
+				return nil, err
+			}
+
+			val = appendProtoFixed64(val, protoFloat, math.Float64bits(f))
+		}
+	case string:
+		val = appendProtoString(val, protoString, v)
+	case []byte:
+		val = appendProtoBytes(val, protoBytes, v)
+	case time.Time:
+		ts := appendProtoVarint(nil, 1, uint64(v.Unix()))
+		ts = appendProtoVarint(ts, 2, uint64(v.Nanosecond()))
+		val = appendProtoBytes(val, protoTimestamp, ts)
+	case []interface{}:
+		row, err := encodeProtoRow(v)
+		if err != nil {
+			return nil, err
+		}
+
+		val = appendProtoBytes(val, protoArray, row)
+	default:
+		return nil, fmt.Errorf("unsupported type %T", v)
+	}
+
+	return appendProtoBytes(buf, num, val), nil
+}
+
+// decodeProtoRow decodes array of values at depth of nesting
+func decodeProtoRow(data []byte, depth int) ([]interface{}, error) {
+	if depth > maxDepth {
+		return nil, errProtoDepth
+	}
+
+	row := []interface{}{}
+
+	err := walkProto(data, func(num int, wire int, field []byte, _ uint64) error {
+		if num != 1 || wire != wireBytes {
+			return nil
+		}
+
+		v, err := decodeProtoValue(field, depth)
+		if err != nil {
+			return err
+		}
+
+		row = append(row, v)
+
+		return nil
+	})
+
+	return row, err
+}
+
+func decodeProtoEntry(data []byte) (string, interface{}, error) {
+	var name string
+	var v interface{}
+
+	err := walkProto(data, func(num int, wire int, field []byte, _ uint64) error {
+		switch {
+		case num == 1 && wire == wireBytes:
+			name = string(field)
+		case num == 2 && wire == wireBytes:
+			var err error
+
+			v, err = decodeProtoValue(field, 0)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return name, v, err
+}
+
+// decodeProtoValue decodes value inside of array at depth of nesting
+func decodeProtoValue(data []byte, depth int) (interface{}, error) {
+	var v interface{}
+	set := false
+
+	err := walkProto(data, func(num int, wire int, field []byte, n uint64) error {
+		var err error
+
+		switch {
+		case num == protoNull && wire == wireVarint:
+			v = nil
+		case num == protoBool && wire == wireVarint:
+			v = n != 0
+		case num == protoInt && wire == wireVarint:
+			v = int64(n>>1) ^ -int64(n&1)
+		case num == protoUint && wire == wireVarint:
+			v = n
+		case num == protoFloat && wire == wireFixed64:
+			v = math.Float64frombits(n)
+		case num == protoString && wire == wireBytes:
+			v = string(field)
+		case num == protoBytes && wire == wireBytes:
+			v = append([]byte{}, field...)
+		case num == protoTimestamp && wire == wireBytes:
+			v, err = decodeProtoTimestamp(field)
+		case num == protoArray && wire == wireBytes:
+			v, err = decodeProtoRow(field, depth+1)
+		default:
+			return nil
+		}
+
+		set = true
+
+		return err
+	})
+
+	if err == nil && !set {
+		err = errors.New("proto: value is not set")
+	}
+
+	return v, err
+}
+
+func decodeProtoTimestamp(data []byte) (time.Time, error) {
+	var sec, nsec int64
+
+	err := walkProto(data, func(num int, wire int, _ []byte, n uint64) error {
+		if wire != wireVarint {
+			return nil
+		}
+
+		switch num {
+		case 1:
+			sec = int64(n)
+		case 2:
+			nsec = int64(int32(n))
+		}
+
+		return nil
+	})
+
+	return time.Unix(sec, nsec).UTC(), err
+}
+
+// walkProto calls f for every field of message. Length-delimited fields are
+// passed as data, varint and fixed fields as n.
+func walkProto(buf []byte, f func(num int, wire int, data []byte, n uint64) error) error {
+	pos := 0
+
+	for pos < len(buf) {
+		key, size := readVarint(buf[pos:])
+		if size == 0 {
+			return errProtoShort
+		}
+
+		pos += size
+
+		num := int(key >> 3)
+		wire := int(key & 7)
+
+		var data []byte
+		var n uint64
+
+		switch wire {
+		case wireVarint:
+			n, size = readVarint(buf[pos:])
+			if size == 0 {
+				return errProtoShort
+			}
+
+			pos += size
+		case wireFixed64:
+			if len(buf)-pos < 8 {
+				return errProtoShort
+			}
+
+			n = readUint64LE(buf[pos : pos+8])
+			pos += 8
+		case wireFixed32:
+			if len(buf)-pos < 4 {
+				return errProtoShort
+			}
+
+			n = readUint64LE(buf[pos : pos+4])
+			pos += 4
+		case wireBytes:
+			l, size := readVarint(buf[pos:])
+			if size == 0 || uint64(len(buf)-pos-size) < l {
+				return errProtoShort
+			}
+
+			pos += size
+			data = buf[pos : pos+int(l)]
+			pos += int(l)
+		default:
+			return fmt.Errorf("proto: unsupported wire type %d", wire)
+		}
+
+		err := f(num, wire, data, n)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readVarint returns value and number of read bytes, 0 if data is invalid
+func readVarint(buf []byte) (uint64, int) {
+	var n uint64
+
+	for i, b := range buf {
+		if i == 10 {
+			return 0, 0
+		}
+
+		n |= uint64(b&0x7f) << (7 * uint(i))
+
+		if b < 0x80 {
+			return n, i + 1
+		}
+	}
+
+	return 0, 0
+}
+
+func readUint64LE(b []byte) uint64 {
+	var n uint64
+
+	for i := len(b) - 1; i >= 0; i-- {
+		n = n<<8 | uint64(b[i])
+	}
+
+	return n
+}
+
+func zigzag(n int64) uint64 {
+	return uint64(n<<1) ^ uint64(n>>63)
+}
+
+func appendVarint(buf []byte, n uint64) []byte {
+	for n >= 0x80 {
+		buf = append(buf, byte(n)|0x80)
+		n >>= 7
+	}
+
+	return append(buf, byte(n))
+}
+
+func appendProtoVarint(buf []byte, num int, n uint64) []byte {
+	buf = appendVarint(buf, uint64(num)<<3|wireVarint)
+	return appendVarint(buf, n)
+}
+
+func appendProtoFixed64(buf []byte, num int, n uint64) []byte {
+	buf = appendVarint(buf, uint64(num)<<3|wireFixed64)
+
+	for i := 0; i < 8; i++ {
+		buf = append(buf, byte(n>>(8*uint(i))))
+	}
+
+	return buf
+}
+
+func appendProtoBytes(buf []byte, num int, data []byte) []byte {
+	buf = appendVarint(buf, uint64(num)<<3|wireBytes)
+	buf = appendVarint(buf, uint64(len(data)))
+
+	return append(buf, data...)
+}
+
+func appendProtoString(buf []byte, num int, s string) []byte {
+	return appendProtoBytes(buf, num, []byte(s))
+}
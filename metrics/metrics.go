@@ -0,0 +1,247 @@
+// Package metrics - minimal Prometheus metrics registry with text exposition
+// format handler.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are default histogram buckets
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var registry = struct {
+	metrics []metric
+	m       sync.Mutex
+}{}
+
+func register(m metric) {
+	registry.m.Lock()
+	registry.metrics = append(registry.metrics, m)
+	registry.m.Unlock()
+}
+
+// Handler returns HTTP handler, which exposes all metrics in Prometheus text
+// format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		registry.m.Lock()
+		metrics := registry.metrics
+		registry.m.Unlock()
+
+		for _, m := range metrics {
+			m.write(w)
+		}
+	})
+}
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.typ)
+}
+
+// key joins label values to series key
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats labels of series with extra label
+func (d desc) labelPairs(key string, extra ...string) string {
+	var pairs []string
+
+	if len(d.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+"="+strconv.Quote(v))
+		}
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Value holds counters and gauges series
+type Value struct {
+	desc
+	values map[string]float64
+	m      sync.Mutex
+}
+
+// NewCounter creates and registers counter
+func NewCounter(name, help string, labels ...string) *Value {
+	return newValue(name, help, "counter", labels)
+}
+
+// NewGauge creates and registers gauge
+func NewGauge(name, help string, labels ...string) *Value {
+	return newValue(name, help, "gauge", labels)
+}
+
+func newValue(name, help, typ string, labels []string) *Value {
+	v := &Value{
+		desc:   desc{name: name, help: help, typ: typ, labels: labels},
+		values: make(map[string]float64),
+	}
+
+	register(v)
+
+	return v
+}
+
+// Inc increments value by 1
+func (v *Value) Inc(labels ...string) {
+	v.Add(1, labels...)
+}
+
+// Add adds delta to value
+func (v *Value) Add(delta float64, labels ...string) {
+	key := v.key(labels)
+
+	v.m.Lock()
+	v.values[key] += delta
+	v.m.Unlock()
+}
+
+// Set sets gauge value
+func (v *Value) Set(val float64, labels ...string) {
+	key := v.key(labels)
+
+	v.m.Lock()
+	v.values[key] = val
+	v.m.Unlock()
+}
+
+func (v *Value) write(w io.Writer) {
+	v.m.Lock()
+	defer v.m.Unlock()
+
+	v.header(w)
+
+	for _, key := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelPairs(key), formatFloat(v.values[key]))
+	}
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	desc
+	buckets []float64
+	series  map[string]*histogramSeries
+	m       sync.Mutex
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates and registers histogram
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		desc:    desc{name: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+
+	register(h)
+
+	return h
+}
+
+// Observe adds observation
+func (h *Histogram) Observe(val float64, labels ...string) {
+	key := h.key(labels)
+
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+
+	i := sort.SearchFloat64s(h.buckets, val)
+	if i < len(h.buckets) {
+		s.counts[i]++
+	}
+
+	s.count++
+	s.sum += val
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	h.header(w)
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, "le", formatFloat(upper)), cumulative)
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(key), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(key), s.count)
+	}
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
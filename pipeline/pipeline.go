@@ -0,0 +1,169 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"git.aqq.me/go/app/appconf"
+	"git.aqq.me/go/app/event"
+	"github.com/iph0/conf"
+	"github.com/kak-tus/corrie/reader"
+	"github.com/kak-tus/corrie/writer"
+)
+
+// DefaultName is name of pipeline, configured only with reader and writer
+// sections, if pipelines are not listed
+const DefaultName = "default"
+
+// Pipeline is independent pair of reader from RabbitMQ queue and writer to
+// Clickhouse
+type Pipeline struct {
+	Name   string
+	Reader *reader.Reader
+	Writer *writer.Writer
+}
+
+// Pipeline config overrides reader and writer sections
+type pipelineConfig struct {
+	Name   string
+	Batch  int
+	Reader map[string]interface{}
+	Writer map[string]interface{}
+}
+
+var pipelines []*Pipeline
+
+func init() {
+	event.Init.AddHandler(
+		func() error {
+			cnfMap := appconf.GetConfig()
+
+			var cnf []pipelineConfig
+			err := conf.Decode(cnfMap["pipelines"], &cnf)
+			if err != nil {
+				return err
+			}
+
+			if len(cnf) == 0 {
+				cnf = []pipelineConfig{{Name: DefaultName}}
+			}
+
+			names := make(map[string]bool)
+
+			for _, pc := range cnf {
+				if pc.Name == "" {
+					return errors.New("pipeline name is empty")
+				}
+
+				if names[pc.Name] {
+					return fmt.Errorf("duplicate pipeline name %q", pc.Name)
+				}
+
+				names[pc.Name] = true
+
+				readerConfig := cnfMap["reader"]
+				writerConfig := cnfMap["writer"]
+
+				if pc.Batch > 0 {
+					batch := map[string]interface{}{"batch": pc.Batch}
+					readerConfig = merge(readerConfig, batch)
+					writerConfig = merge(writerConfig, batch)
+				}
+
+				readerConfig = merge(readerConfig, pc.Reader)
+				writerConfig = merge(writerConfig, pc.Writer)
+
+				rdr, err := reader.New(pc.Name, readerConfig)
+				if err != nil {
+					return fmt.Errorf("pipeline %s: %v", pc.Name, err)
+				}
+
+				wrt, err := writer.New(pc.Name, rdr, writerConfig)
+				if err != nil {
+					return fmt.Errorf("pipeline %s: %v", pc.Name, err)
+				}
+
+				pipelines = append(pipelines, &Pipeline{Name: pc.Name, Reader: rdr, Writer: wrt})
+			}
+
+			return nil
+		},
+	)
+
+	event.Stop.AddHandler(
+		func() error {
+			// Pipelines are drained in parallel to fit in drain timeout
+			var wg sync.WaitGroup
+
+			for _, p := range pipelines {
+				wg.Add(1)
+
+				go func(p *Pipeline) {
+					p.Writer.Close()
+					p.Reader.Close()
+					wg.Done()
+				}(p)
+			}
+
+			wg.Wait()
+
+			return nil
+		},
+	)
+}
+
+// GetPipelines returns all pipelines in config order
+func GetPipelines() []*Pipeline {
+	return pipelines
+}
+
+// GetPipeline returns pipeline by name or first pipeline, if name is empty
+func GetPipeline(name string) (*Pipeline, error) {
+	if name == "" && len(pipelines) > 0 {
+		return pipelines[0], nil
+	}
+
+	for _, p := range pipelines {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown pipeline %q", name)
+}
+
+// merge overrides values of base config with values of pipeline config. Maps
+// are merged recursively, any other values, including lists, are replaced as
+// whole, so pipeline list never inherits items of base list.
+func merge(base interface{}, override map[string]interface{}) interface{} {
+	if override == nil {
+		return base
+	}
+
+	baseMap, ok := base.(map[string]interface{})
+	if !ok {
+		return override
+	}
+
+	merged := make(map[string]interface{}, len(baseMap))
+
+	for k, v := range baseMap {
+		merged[k] = v
+	}
+
+	for k, v := range override {
+		if v == nil {
+			continue
+		}
+
+		if m, ok := v.(map[string]interface{}); ok {
+			merged[k] = merge(baseMap[k], m)
+			continue
+		}
+
+		merged[k] = v
+	}
+
+	return merged
+}
@@ -0,0 +1,100 @@
+package pipeline
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     interface{}
+		override map[string]interface{}
+		out      interface{}
+	}{
+		{
+			name: "no override",
+			base: map[string]interface{}{"batch": 10},
+			out:  map[string]interface{}{"batch": 10},
+		},
+		{
+			name:     "no base",
+			override: map[string]interface{}{"batch": 10},
+			out:      map[string]interface{}{"batch": 10},
+		},
+		{
+			name:     "scalar",
+			base:     map[string]interface{}{"batch": 10, "workers": 2},
+			override: map[string]interface{}{"batch": 20},
+			out:      map[string]interface{}{"batch": 20, "workers": 2},
+		},
+		{
+			name:     "zero value",
+			base:     map[string]interface{}{"breaker": map[string]interface{}{"replay": true, "threshold": 5}},
+			override: map[string]interface{}{"breaker": map[string]interface{}{"replay": false}},
+			out:      map[string]interface{}{"breaker": map[string]interface{}{"replay": false, "threshold": 5}},
+		},
+		{
+			name:     "null value",
+			base:     map[string]interface{}{"batch": 10},
+			override: map[string]interface{}{"batch": nil},
+			out:      map[string]interface{}{"batch": 10},
+		},
+		{
+			name: "shorter list",
+			base: map[string]interface{}{
+				"policy": map[string]interface{}{
+					"tables": []interface{}{
+						map[string]interface{}{"database": "a", "table": "x"},
+						map[string]interface{}{"database": "b", "table": "*"},
+					},
+					"statements": []interface{}{"INSERT"},
+				},
+			},
+			override: map[string]interface{}{
+				"policy": map[string]interface{}{
+					"tables": []interface{}{
+						map[string]interface{}{"database": "c", "table": "y"},
+					},
+				},
+			},
+			out: map[string]interface{}{
+				"policy": map[string]interface{}{
+					"tables": []interface{}{
+						map[string]interface{}{"database": "c", "table": "y"},
+					},
+					"statements": []interface{}{"INSERT"},
+				},
+			},
+		},
+		{
+			name:     "empty list",
+			base:     map[string]interface{}{"users": []interface{}{"a", "b"}},
+			override: map[string]interface{}{"users": []interface{}{}},
+			out:      map[string]interface{}{"users": []interface{}{}},
+		},
+	}
+
+	for _, tt := range tests {
+		out := merge(tt.base, tt.override)
+
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("%s: got %v, want %v", tt.name, out, tt.out)
+		}
+	}
+}
+
+func TestMergeKeepsBase(t *testing.T) {
+	base := map[string]interface{}{
+		"rabbit": map[string]interface{}{"queue": "messages"},
+	}
+
+	merge(base, map[string]interface{}{
+		"rabbit": map[string]interface{}{"queue": "events"},
+	})
+
+	// Base config is shared by all pipelines
+	if base["rabbit"].(map[string]interface{})["queue"] != "messages" {
+		t.Errorf("base config is changed: %v", base)
+	}
+}
@@ -0,0 +1,193 @@
+package reader
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"git.aqq.me/go/nanachi"
+	"go.uber.org/zap"
+)
+
+// Prefix of failed queue publishes correlation ID
+const correlationPrefix = "corrie-"
+
+// Default timeout of failed queue publish confirm in seconds
+const defaultConfirmTimeout = 60
+
+// confirms tracks deliveries, published to failed queue and waiting for
+// publish confirm to be acked
+type confirms struct {
+	pipeline string
+	logger   *zap.SugaredLogger
+	timeout  time.Duration
+	notifier *nanachi.ConfirmChanNotifier
+	pending  map[string]*pendingFailure
+	seq      uint64
+	m        *sync.Mutex
+	stop     chan struct{}
+	wg       *sync.WaitGroup
+	// Publishes in progress hold read lock, producer is closed under write lock
+	publishing *sync.RWMutex
+	closed     bool
+}
+
+type pendingFailure struct {
+	delivery *nanachi.Delivery
+	sentAt   time.Time
+}
+
+func newConfirms(pipeline string, timeout time.Duration, logger *zap.SugaredLogger) *confirms {
+	return &confirms{
+		pipeline: pipeline,
+		logger:   logger,
+		timeout:  timeout,
+		notifier: nanachi.NewConfirmChanNotifier(1000),
+		pending:  make(map[string]*pendingFailure),
+		m:        &sync.Mutex{},
+		stop:     make(chan struct{}),
+		wg:       &sync.WaitGroup{},
+
+		publishing: &sync.RWMutex{},
+	}
+}
+
+// acquire allows publish, if producer is not closed. Publish must be released
+// after send.
+func (c *confirms) acquire() bool {
+	c.publishing.RLock()
+
+	if c.closed {
+		c.publishing.RUnlock()
+		return false
+	}
+
+	return true
+}
+
+func (c *confirms) release() {
+	c.publishing.RUnlock()
+}
+
+// forbid waits, while publishes in progress are sent, and forbids new ones
+func (c *confirms) forbid() {
+	c.publishing.Lock()
+	c.closed = true
+	c.publishing.Unlock()
+}
+
+// add registers delivery and returns correlation ID for its publish
+func (c *confirms) add(m *nanachi.Delivery) string {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.seq++
+	cid := correlationPrefix + strconv.FormatUint(c.seq, 10)
+
+	c.pending[cid] = &pendingFailure{delivery: m, sentAt: time.Now()}
+
+	return cid
+}
+
+// take removes delivery from pending
+func (c *confirms) take(cid string) (*pendingFailure, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	p, ok := c.pending[cid]
+	if ok {
+		delete(c.pending, cid)
+	}
+
+	return p, ok
+}
+
+// run acks deliveries on publish confirms and requeues them on publish failure
+// or confirm timeout
+func (c *confirms) run() {
+	c.wg.Add(1)
+
+	go func() {
+		defer c.wg.Done()
+
+		tick := time.NewTicker(time.Second)
+		defer tick.Stop()
+
+		for {
+			select {
+			case cfm, ok := <-c.notifier.C:
+				if !ok {
+					return
+				}
+
+				p, ok := c.take(cfm.CorrelationId)
+				if !ok {
+					continue
+				}
+
+				if cfm.Ack {
+					c.ack(p)
+				} else {
+					c.requeue(p, "publish to failed queue failed")
+				}
+			case <-tick.C:
+				c.expire()
+			}
+		}
+	}()
+}
+
+// close waits, while all received confirms are handled. Deliveries, that are
+// still not confirmed, are left unacked.
+func (c *confirms) close() int {
+	c.notifier.Close()
+	c.wg.Wait()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return len(c.pending)
+}
+
+func (c *confirms) expire() {
+	deadline := time.Now().Add(-c.timeout)
+
+	var expired []*pendingFailure
+
+	c.m.Lock()
+
+	for cid, p := range c.pending {
+		if p.sentAt.Before(deadline) {
+			delete(c.pending, cid)
+			expired = append(expired, p)
+		}
+	}
+
+	c.m.Unlock()
+
+	for _, p := range expired {
+		c.requeue(p, "failed queue publish confirm timeout")
+	}
+}
+
+func (c *confirms) ack(p *pendingFailure) {
+	err := p.delivery.Ack(false)
+	if err != nil {
+		c.logger.Errorf("Ack failed: %v", err)
+		return
+	}
+
+	failedConfirmed.Inc(c.pipeline)
+}
+
+func (c *confirms) requeue(p *pendingFailure, reason string) {
+	c.logger.Errorf("Requeue message %q: %s", p.delivery.MessageId, reason)
+
+	err := p.delivery.Nack(false, true)
+	if err != nil {
+		c.logger.Errorf("Nack failed: %v", err)
+		return
+	}
+
+	failedRequeued.Inc(c.pipeline)
+}
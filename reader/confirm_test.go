@@ -0,0 +1,39 @@
+package reader
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfirmsForbid(t *testing.T) {
+	c := newConfirms("test", time.Second, nil)
+
+	if !c.acquire() {
+		t.Fatal("publish is refused before producer is closed")
+	}
+
+	forbidden := make(chan struct{})
+
+	go func() {
+		c.forbid()
+		close(forbidden)
+	}()
+
+	select {
+	case <-forbidden:
+		t.Fatal("producer is closed while publish is in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.release()
+
+	select {
+	case <-forbidden:
+	case <-time.After(time.Second):
+		t.Fatal("producer is not closed after publish is released")
+	}
+
+	if c.acquire() {
+		t.Error("publish is allowed after producer is closed")
+	}
+}
@@ -0,0 +1,21 @@
+package reader
+
+import "github.com/kak-tus/corrie/metrics"
+
+var (
+	rabbitErrors = metrics.NewCounter(
+		"corrie_rabbitmq_errors_total", "Errors, reported by RabbitMQ client", "pipeline",
+	)
+	failedConfirmed = metrics.NewCounter(
+		"corrie_failed_confirmed_total", "Failed messages, acked after failed queue publish confirm", "pipeline",
+	)
+	failedRequeued = metrics.NewCounter(
+		"corrie_failed_requeued_total", "Failed messages, requeued because failed queue publish is not confirmed", "pipeline",
+	)
+	retried = metrics.NewCounter(
+		"corrie_retried_total", "Failed messages, published to retry queue", "pipeline", "queue",
+	)
+	rebalanced = metrics.NewCounter(
+		"corrie_rebalanced_total", "Messages, moved from orphaned shards to current shards", "pipeline", "queue",
+	)
+)
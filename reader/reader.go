@@ -1,87 +1,100 @@
 package reader
 
 import (
+	"errors"
 	"fmt"
+	"os"
 	"time"
 
-	"git.aqq.me/go/app/appconf"
 	"git.aqq.me/go/app/applog"
-	"git.aqq.me/go/app/event"
 	"git.aqq.me/go/nanachi"
-	"git.aqq.me/go/retrier"
 	"github.com/iph0/conf"
 	"github.com/streadway/amqp"
 )
 
-var rdr *Reader
+// New creates reader of pipeline
+func New(name string, cnfMap interface{}) (*Reader, error) {
+	var cnf readerConfig
 
-func init() {
-	event.Init.AddHandler(
-		func() error {
-			cnfMap := appconf.GetConfig()["reader"]
+	err := conf.Decode(cnfMap, &cnf)
+	if err != nil {
+		return nil, err
+	}
 
-			var cnf readerConfig
-			err := conf.Decode(cnfMap, &cnf)
-			if err != nil {
-				return err
-			}
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
 
-			rdr = &Reader{
-				logger: applog.GetLogger().Sugar(),
-				config: cnf,
-			}
+	if cnf.Rabbit.PingTimeout <= 0 {
+		cnf.Rabbit.PingTimeout = defaultPingTimeout
+	}
 
-			rdr.logger.Info("Started reader")
+	if cnf.Rabbit.ConfirmTimeout <= 0 {
+		cnf.Rabbit.ConfirmTimeout = defaultConfirmTimeout
+	}
 
-			return nil
-		},
-	)
+	if cnf.Rabbit.RebalancePeriod <= 0 {
+		cnf.Rabbit.RebalancePeriod = defaultRebalancePeriod
+	}
 
-	event.Stop.AddHandler(
-		func() error {
-			rdr.logger.Info("Stop reader")
+	// maxShard is supported for compatibility with old configs
+	if cnf.Rabbit.Shards == 0 && cnf.Rabbit.MaxShard > 0 {
+		cnf.Rabbit.Shards = cnf.Rabbit.MaxShard + 1
+	}
 
-			rdr.consumerClient.Close()
-			rdr.producerClient.Close()
+	if cnf.Rabbit.Shards == 0 {
+		cnf.Rabbit.Shards = defaultShards
+	}
 
-			return nil
-		},
-	)
+	// With one shard nanachi uses not sharded queue name
+	if cnf.Rabbit.Shards < 2 {
+		return nil, errors.New("reader.rabbit.shards must be at least 2")
+	}
+
+	cnf.Rabbit.MaxShard = cnf.Rabbit.Shards - 1
+
+	err = cnf.Rabbit.checkTopology()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{
+		name:   name,
+		logger: applog.GetLogger().Sugar().With("pipeline", name),
+		config: cnf,
+		host:   host,
+		state:  &readerState{consumer: ConsumerIdle},
+	}
+
+	r.logger.Info("Started reader")
+
+	return r, nil
 }
 
-// GetReader return instance
-func GetReader() *Reader {
-	return rdr
+// Close stops rebalance and closes RabbitMQ clients
+func (r *Reader) Close() {
+	r.logger.Info("Stop reader")
+
+	// Not started, if used only to replay messages
+	if r.consumerClient == nil {
+		return
+	}
+
+	r.stopRebalance()
+
+	r.consumerClient.Close()
+	r.producerClient.Close()
 }
 
 // Start reader
 func (r *Reader) Start() {
-	consumerClient, err := nanachi.NewClient(
-		nanachi.ClientConfig{
-			URI:           r.config.Rabbit.URI,
-			Heartbeat:     time.Second * 15,
-			ErrorNotifier: r,
-			RetrierConfig: &retrier.Config{
-				RetryPolicy: []time.Duration{time.Second},
-				MaxAttempts: r.config.Rabbit.MaxRetry,
-			},
-		},
-	)
+	consumerClient, err := r.newClient()
 	if err != nil {
 		r.logger.Panic(err)
 	}
 
-	producerClient, err := nanachi.NewClient(
-		nanachi.ClientConfig{
-			URI:           r.config.Rabbit.URI,
-			Heartbeat:     time.Second * 15,
-			ErrorNotifier: r,
-			RetrierConfig: &retrier.Config{
-				RetryPolicy: []time.Duration{time.Second},
-				MaxAttempts: r.config.Rabbit.MaxRetry,
-			},
-		},
-	)
+	producerClient, err := r.newClient()
 	if err != nil {
 		r.logger.Panic(err)
 	}
@@ -92,7 +105,7 @@ func (r *Reader) Start() {
 	src := &nanachi.Source{
 		Queue:    r.config.Rabbit.Queue,
 		MaxShard: int32(r.config.Rabbit.MaxShard),
-		Declare:  rdr.declare,
+		Declare:  r.declare,
 	}
 
 	// Prefetch count must be greater then batch, to prevent temporary blocking
@@ -114,65 +127,225 @@ func (r *Reader) Start() {
 	r.C = msgs
 
 	dst := &nanachi.Destination{
+		Exchange:   r.config.Rabbit.FailedExchange.Name,
 		RoutingKey: r.config.Rabbit.QueueFailed,
-		Declare:    rdr.declare,
+		Declare:    r.declare,
 	}
 
+	r.confirms = newConfirms(r.name, time.Duration(r.config.Rabbit.ConfirmTimeout)*time.Second, r.logger)
+	r.confirms.run()
+
 	producer := r.producerClient.NewSmartProducer(
 		nanachi.SmartProducerConfig{
-			Destinations:      []*nanachi.Destination{dst},
+			Destinations:      append([]*nanachi.Destination{dst}, r.retryDestinations()...),
 			Mandatory:         true,
 			PendingBufferSize: 1000000,
 			Confirm:           true,
+			ConfirmNotifier:   r.confirms.notifier,
 		},
 	)
 
 	r.producer = producer
+
+	r.startRebalance()
+
+	r.state.setConsumer(ConsumerConsuming)
 }
 
 // Notify nanachi method
-func (r Reader) Notify(err error) {
+func (r *Reader) Notify(err error) {
+	rabbitErrors.Inc(r.name)
+	r.state.setError(err)
 	r.logger.Error(err)
 }
 
-func (r Reader) declare(ch *amqp.Channel) error {
-	for i := 0; i <= r.config.Rabbit.MaxShard; i++ {
-		shardName := fmt.Sprintf("%s.%d", r.config.Rabbit.Queue, i)
+// IsAccessible checks RabbitMQ status
+func (r *Reader) IsAccessible() bool {
+	return r.ping() == nil
+}
 
-		_, err := ch.QueueDeclare(shardName, true, false, false, false, nil)
-		if err != nil {
-			return err
-		}
+// Stop reader
+func (r Reader) Stop() {
+	if r.consumer == nil {
+		return
+	}
 
-		_, err = ch.QueueDeclare(r.config.Rabbit.QueueFailed, true, false, false, false, nil)
-		if err != nil {
-			return err
-		}
+	r.state.setConsumer(ConsumerStopped)
+
+	r.consumer.Cancel()
+}
+
+// CloseProducer waits, while failed queue publishes are confirmed and their
+// messages are acked, and closes producer. Returns error, if not all publishes
+// are confirmed in time.
+func (r *Reader) CloseProducer(timeout time.Duration) error {
+	if r.producer == nil {
+		return nil
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		r.confirms.forbid()
+		r.producer.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		return errors.New("failed queue publishes are not confirmed in time")
+	}
+
+	left := r.confirms.close()
+	if left > 0 {
+		return fmt.Errorf("%d failed queue publishes are not confirmed", left)
 	}
 
 	return nil
 }
 
-// IsAccessible checks RabbitMQ status
-func (r Reader) IsAccessible() bool {
-	// TODO ping
-	return true
+// ToFailedQueue move message to failed queue or, if failure stage is retried
+// and not all retry attempts are used, to next retry queue. Failure details
+// are stored in message headers. Message is acked after publish is confirmed
+// or requeued, if publish fails or is not confirmed in time.
+func (r Reader) ToFailedQueue(m *nanachi.Delivery, failure Failure) {
+	r.publishFailed(m, m.Body, m.ContentEncoding, failure)
 }
 
-// Stop reader
-func (r Reader) Stop() {
-	r.consumer.Cancel()
+// ToFailedQueueWithBody publishes new message with body, compressed with
+// encoding, to failed queue instead of original message, for example with
+// failed rows of multi-row message. Original message is acked after publish
+// is confirmed.
+func (r Reader) ToFailedQueueWithBody(m *nanachi.Delivery, body []byte, encoding string, failure Failure) {
+	r.publishFailed(m, body, encoding, failure)
+}
+
+// ToParkingQueue publishes message with body, compressed with encoding, to
+// parking queue of table, while inserts to table are stopped. Message is
+// acked after publish is confirmed.
+func (r Reader) ToParkingQueue(m *nanachi.Delivery, body []byte, encoding string, table string, failure Failure) {
+	if !r.confirms.acquire() {
+		r.logger.Errorf("Leave message %q unacked, producer is closed", m.MessageId)
+		return
+	}
+
+	defer r.confirms.release()
+
+	queue := r.ParkingQueue(table)
+
+	if !r.producer.CanSend("", queue) {
+		r.producer.AddDestination(
+			&nanachi.Destination{
+				RoutingKey: queue,
+				Declare: func(ch *amqp.Channel) error {
+					_, err := ch.QueueDeclare(queue, true, false, false, false, r.config.Rabbit.FailedQueueArgs.table())
+					return err
+				},
+			},
+		)
+	}
+
+	r.publish(m, body, encoding, failure, "", queue, false)
 }
 
-// ToFailedQueue move message to failed queue
-func (r Reader) ToFailedQueue(m *nanachi.Delivery) {
+// ParkingQueue returns name of parking queue of table, like
+// "messages.parked.default.test"
+func (r Reader) ParkingQueue(table string) string {
+	return r.config.Rabbit.Queue + ".parked." + table
+}
+
+func (r Reader) publishFailed(m *nanachi.Delivery, body []byte, encoding string, failure Failure) {
+	if !r.confirms.acquire() {
+		r.logger.Errorf("Leave message %q unacked, producer is closed", m.MessageId)
+		return
+	}
+
+	defer r.confirms.release()
+
+	tier := r.retryTier(m.Headers, failure)
+	if tier < 0 {
+		r.publish(m, body, encoding, failure, r.config.Rabbit.FailedExchange.Name, r.config.Rabbit.QueueFailed, false)
+		return
+	}
+
+	exchange := r.retryQueue(tier)
+	retried.Inc(r.name, exchange)
+
+	r.publish(m, body, encoding, failure, exchange, r.retryShard(m.Headers), true)
+}
+
+// publish publishes message with failure details in headers. Original headers
+// are moved to HeaderOriginalHeader or, for retried message, are kept.
+func (r Reader) publish(m *nanachi.Delivery, body []byte, encoding string, failure Failure,
+	exchange string, routingKey string, retry bool) {
+	now := time.Now()
+
+	headers := amqp.Table{
+		HeaderStage:          failure.Stage,
+		HeaderErrorCode:      failure.Code,
+		HeaderError:          failure.Error,
+		HeaderQueue:          m.RoutingKey,
+		HeaderMessageID:      m.MessageId,
+		HeaderFirstFailedAt:  now,
+		HeaderLastFailedAt:   now,
+		HeaderHost:           r.host,
+		HeaderAttempts:       int32(1),
+		HeaderOriginalHeader: amqp.Table{},
+	}
+
+	original := amqp.Table{}
+
+	for k, v := range m.Headers {
+		switch k {
+		case HeaderFirstFailedAt:
+			headers[k] = v
+		case HeaderAttempts:
+			attempts, ok := v.(int32)
+			if ok {
+				headers[k] = attempts + 1
+			}
+		case HeaderOriginalHeader:
+			prev, ok := v.(amqp.Table)
+			if ok {
+				for pk, pv := range prev {
+					original[pk] = pv
+				}
+			}
+		case HeaderStage, HeaderErrorCode, HeaderError, HeaderQueue,
+			HeaderMessageID, HeaderLastFailedAt, HeaderHost:
+		default:
+			// Retried message keeps its headers, retry attempts are counted
+			// by RabbitMQ in x-death
+			if retry {
+				headers[k] = v
+			} else {
+				original[k] = v
+			}
+		}
+	}
+
+	headers[HeaderOriginalHeader] = original
+
+	contentType := m.ContentType
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+
 	r.producer.Send(
 		nanachi.Publishing{
-			RoutingKey: r.config.Rabbit.QueueFailed,
+			Exchange:   exchange,
+			RoutingKey: routingKey,
 			Publishing: amqp.Publishing{
-				ContentType:  "text/plain",
-				Body:         m.Body,
-				DeliveryMode: amqp.Persistent,
+				Headers:         headers,
+				ContentType:     contentType,
+				ContentEncoding: encoding,
+				MessageId:       m.MessageId,
+				Timestamp:       m.Timestamp,
+				AppId:           m.AppId,
+				Body:            body,
+				DeliveryMode:    amqp.Persistent,
+				CorrelationId:   r.confirms.add(m),
 			},
 		},
 	)
@@ -0,0 +1,192 @@
+package reader
+
+import (
+	"strings"
+	"time"
+
+	"github.com/kak-tus/corrie/message"
+	"github.com/streadway/amqp"
+)
+
+// ReplayConfig holds filters and options of failed messages replay
+type ReplayConfig struct {
+	// Queue to replay from, failed queue by default
+	Queue string
+	// Replay only messages with query, containing substring
+	Query string
+	// Replay only messages, failed on stage
+	Stage string
+	// Replay only messages with ClickHouse error code
+	Code int32
+	// Maximum number of replayed messages, 0 - no limit
+	Limit int
+	// Only count matched messages, don't replay
+	DryRun bool
+	// Publish confirmation timeout
+	ConfirmTimeout time.Duration
+}
+
+// ReplayStats holds replay results
+type ReplayStats struct {
+	Scanned  int
+	Matched  int
+	Replayed int
+}
+
+// Replay moves messages from failed or parking queue back to source queue.
+// Message is acked in failed queue only after publish to source queue is
+// confirmed. Not replayed messages are moved to the end of queue the same way,
+// so only one message at a time is held unacked. Scan stops after messages,
+// that were in queue at start.
+func (r *Reader) Replay(cnf ReplayConfig) (ReplayStats, error) {
+	var stats ReplayStats
+
+	client, err := r.newClient()
+	if err != nil {
+		return stats, err
+	}
+
+	defer client.Close()
+
+	ch, err := client.NewChannel()
+	if err != nil {
+		return stats, err
+	}
+
+	// All not acked messages are returned to queue on close
+	defer ch.Close()
+
+	err = r.declare(ch)
+	if err != nil {
+		return stats, err
+	}
+
+	timeout := cnf.ConfirmTimeout
+	if timeout == 0 {
+		timeout = time.Second * 10
+	}
+
+	queue := cnf.Queue
+	if queue == "" {
+		queue = r.config.Rabbit.QueueFailed
+	}
+
+	q, err := ch.QueueInspect(queue)
+	if err != nil {
+		return stats, err
+	}
+
+	mv := r.newMover(client, r.config.Rabbit.Queue, r.config.Rabbit.MaxShard, timeout)
+	defer mv.producer.Close()
+
+	tail := r.newMover(client, queue, 0, timeout)
+	defer tail.producer.Close()
+
+	for stats.Scanned < q.Messages && (cnf.Limit == 0 || stats.Matched < cnf.Limit) {
+		msg, ok, err := ch.Get(queue, false)
+		if err != nil {
+			return stats, err
+		}
+
+		if !ok {
+			break
+		}
+
+		stats.Scanned++
+
+		matched := matchReplay(msg, cnf)
+		if matched {
+			stats.Matched++
+		}
+
+		if !matched || cnf.DryRun {
+			err = tail.move(msg, copyPublishing(msg))
+			if err != nil {
+				return stats, err
+			}
+
+			continue
+		}
+
+		err = mv.move(msg, replayPublishing(msg))
+		if err != nil {
+			return stats, err
+		}
+
+		stats.Replayed++
+	}
+
+	return stats, nil
+}
+
+func matchReplay(msg amqp.Delivery, cnf ReplayConfig) bool {
+	if cnf.Stage != "" {
+		stage, _ := msg.Headers[HeaderStage].(string)
+		if stage != cnf.Stage {
+			return false
+		}
+	}
+
+	if cnf.Code != 0 {
+		code, _ := msg.Headers[HeaderErrorCode].(int32)
+		if code != cnf.Code {
+			return false
+		}
+	}
+
+	if cnf.Query != "" {
+		body, err := message.Decompress(msg.ContentEncoding, msg.Body, message.DefaultMaxSize)
+
+		var parsed message.Message
+		if err == nil {
+			parsed, err = message.DecodeContent(msg.ContentType, body)
+		}
+
+		if err == nil {
+			parsed, err = parsed.ToV1()
+		}
+
+		if err != nil || !strings.Contains(parsed.Query, cnf.Query) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// replayPublishing restores original message with failure history headers
+func replayPublishing(msg amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+
+	original, ok := msg.Headers[HeaderOriginalHeader].(amqp.Table)
+	if ok {
+		for k, v := range original {
+			headers[k] = v
+		}
+	}
+
+	// Let producer choose shard from current shards set
+	delete(headers, "x-shard")
+
+	// Replayed message gets all retry attempts again
+	delete(headers, "x-death")
+
+	for _, k := range []string{HeaderFirstFailedAt, HeaderAttempts} {
+		v, ok := msg.Headers[k]
+		if ok {
+			headers[k] = v
+		}
+	}
+
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		CorrelationId:   msg.CorrelationId,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+		DeliveryMode:    amqp.Persistent,
+	}
+}
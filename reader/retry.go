@@ -0,0 +1,193 @@
+package reader
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"git.aqq.me/go/nanachi"
+	"github.com/streadway/amqp"
+)
+
+// Stages of failures, retried by default
+var defaultRetryStages = []string{StagePrepare, StageExec, StageCommit}
+
+type retryConfig struct {
+	// Message TTL of retry queues in seconds in order of attempts
+	Tiers []int
+	// Stages of failures, retried before moving to failed queue
+	Stages []string
+}
+
+func (c *retryConfig) check() error {
+	names := make(map[int]bool)
+
+	for _, ttl := range c.Tiers {
+		if ttl <= 0 {
+			return fmt.Errorf("invalid retry TTL %d", ttl)
+		}
+
+		if names[ttl] {
+			return fmt.Errorf("duplicate retry TTL %d", ttl)
+		}
+
+		names[ttl] = true
+	}
+
+	if c.Stages == nil {
+		c.Stages = defaultRetryStages
+	}
+
+	for _, stage := range c.Stages {
+		switch stage {
+		case StageDecode, StagePolicy, StagePrepare, StageExec, StageCommit:
+		default:
+			return fmt.Errorf("unknown retry stage %q", stage)
+		}
+	}
+
+	return nil
+}
+
+// retryQueue returns name of retry queue and its exchange, like
+// "messages.retry.30s"
+func (r *Reader) retryQueue(tier int) string {
+	ttl := r.config.Rabbit.Retry.Tiers[tier]
+
+	var suffix string
+
+	switch {
+	case ttl%3600 == 0:
+		suffix = fmt.Sprintf("%dh", ttl/3600)
+	case ttl%60 == 0:
+		suffix = fmt.Sprintf("%dm", ttl/60)
+	default:
+		suffix = fmt.Sprintf("%ds", ttl)
+	}
+
+	return r.config.Rabbit.Queue + ".retry." + suffix
+}
+
+// retryDestinations returns destinations of every retry queue for every shard.
+// Message is published to retry queue with shard queue name as routing key
+// and is dead-lettered with it to shard through default exchange after TTL.
+func (r *Reader) retryDestinations() []*nanachi.Destination {
+	var dsts []*nanachi.Destination
+
+	for tier := range r.config.Rabbit.Retry.Tiers {
+		for i := 0; i <= r.config.Rabbit.MaxShard; i++ {
+			dsts = append(dsts, &nanachi.Destination{
+				Exchange:   r.retryQueue(tier),
+				RoutingKey: r.shardName(i),
+				Declare:    r.declare,
+			})
+		}
+	}
+
+	return dsts
+}
+
+// declareRetry declares fanout exchange and queue of every retry tier
+func (r *Reader) declareRetry(ch *amqp.Channel) error {
+	for tier, ttl := range r.config.Rabbit.Retry.Tiers {
+		name := r.retryQueue(tier)
+
+		err := ch.ExchangeDeclare(name, ExchangeFanout, true, false, false, false, nil)
+		if err != nil {
+			return err
+		}
+
+		args := amqp.Table{
+			"x-message-ttl":          int64(ttl) * 1000,
+			"x-dead-letter-exchange": "",
+		}
+
+		_, err = ch.QueueDeclare(name, true, false, false, false, args)
+		if err != nil {
+			return err
+		}
+
+		err = ch.QueueBind(name, "", name, false, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// retryTier returns retry tier for failed message or -1, if message must be
+// moved to failed queue. Tier is chosen by count of message expirations in
+// retry queues, tracked by RabbitMQ in x-death header.
+func (r *Reader) retryTier(headers amqp.Table, failure Failure) int {
+	cnf := r.config.Rabbit.Retry
+
+	if len(cnf.Tiers) == 0 {
+		return -1
+	}
+
+	retried := false
+
+	for _, stage := range cnf.Stages {
+		if stage == failure.Stage {
+			retried = true
+			break
+		}
+	}
+
+	if !retried {
+		return -1
+	}
+
+	attempts := r.retryAttempts(headers)
+	if attempts >= len(cnf.Tiers) {
+		return -1
+	}
+
+	return attempts
+}
+
+// retryAttempts counts expirations of message in retry queues
+func (r *Reader) retryAttempts(headers amqp.Table) int {
+	deaths, ok := headers["x-death"].([]interface{})
+	if !ok {
+		return 0
+	}
+
+	prefix := r.config.Rabbit.Queue + ".retry."
+	attempts := 0
+
+	for _, d := range deaths {
+		death, ok := d.(amqp.Table)
+		if !ok {
+			continue
+		}
+
+		queue, _ := death["queue"].(string)
+		reason, _ := death["reason"].(string)
+
+		if !strings.HasPrefix(queue, prefix) || reason != "expired" {
+			continue
+		}
+
+		switch count := death["count"].(type) {
+		case int64:
+			attempts += int(count)
+		case int32:
+			attempts += int(count)
+		}
+	}
+
+	return attempts
+}
+
+// retryShard returns shard queue, retried message is returned to. It is the
+// same shard, if it is in current shards set.
+func (r *Reader) retryShard(headers amqp.Table) string {
+	shard, ok := headers["x-shard"].(int32)
+	if !ok || shard < 0 || int(shard) > r.config.Rabbit.MaxShard {
+		shard = rand.Int31n(int32(r.config.Rabbit.MaxShard) + 1)
+	}
+
+	return r.shardName(int(shard))
+}
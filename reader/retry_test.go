@@ -0,0 +1,155 @@
+package reader
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func newRetryReader() *Reader {
+	return &Reader{
+		config: readerConfig{
+			Rabbit: rabbitConfig{
+				Queue:    "messages",
+				MaxShard: 3,
+				Retry: retryConfig{
+					Tiers:  []int{30, 600, 7200},
+					Stages: defaultRetryStages,
+				},
+			},
+		},
+	}
+}
+
+func TestRetryQueue(t *testing.T) {
+	r := newRetryReader()
+
+	tests := []string{"messages.retry.30s", "messages.retry.10m", "messages.retry.2h"}
+
+	for tier, queue := range tests {
+		if got := r.retryQueue(tier); got != queue {
+			t.Errorf("tier %d: got %q, want %q", tier, got, queue)
+		}
+	}
+}
+
+func TestRetryAttempts(t *testing.T) {
+	r := newRetryReader()
+
+	tests := []struct {
+		name     string
+		headers  amqp.Table
+		attempts int
+	}{
+		{"no x-death", amqp.Table{}, 0},
+		{"invalid x-death", amqp.Table{"x-death": "expired"}, 0},
+		{
+			name: "expirations in retry queues",
+			headers: amqp.Table{"x-death": []interface{}{
+				amqp.Table{"queue": "messages.retry.30s", "reason": "expired", "count": int64(1)},
+				amqp.Table{"queue": "messages.retry.10m", "reason": "expired", "count": int32(2)},
+			}},
+			attempts: 3,
+		},
+		{
+			name: "other queues and reasons",
+			headers: amqp.Table{"x-death": []interface{}{
+				amqp.Table{"queue": "messages.0", "reason": "expired", "count": int64(5)},
+				amqp.Table{"queue": "messages.retry.30s", "reason": "rejected", "count": int64(5)},
+				amqp.Table{"queue": "other.retry.30s", "reason": "expired", "count": int64(5)},
+				"invalid",
+			}},
+			attempts: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		if got := r.retryAttempts(tt.headers); got != tt.attempts {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.attempts)
+		}
+	}
+}
+
+func TestRetryTier(t *testing.T) {
+	r := newRetryReader()
+
+	expired := func(count int64) amqp.Table {
+		return amqp.Table{"x-death": []interface{}{
+			amqp.Table{"queue": "messages.retry.30s", "reason": "expired", "count": count},
+		}}
+	}
+
+	tests := []struct {
+		name    string
+		headers amqp.Table
+		stage   string
+		tier    int
+	}{
+		{"first failure", amqp.Table{}, StageCommit, 0},
+		{"second failure", expired(1), StageExec, 1},
+		{"last tier", expired(2), StagePrepare, 2},
+		{"tiers are used", expired(3), StageCommit, -1},
+		{"not retried stage", amqp.Table{}, StageDecode, -1},
+	}
+
+	for _, tt := range tests {
+		if got := r.retryTier(tt.headers, Failure{Stage: tt.stage}); got != tt.tier {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.tier)
+		}
+	}
+
+	// Without tiers messages are moved to failed queue at once
+	r.config.Rabbit.Retry.Tiers = nil
+
+	if got := r.retryTier(amqp.Table{}, Failure{Stage: StageCommit}); got != -1 {
+		t.Errorf("without tiers: got %d, want -1", got)
+	}
+}
+
+func TestRetryConfigCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		cnf  retryConfig
+		err  bool
+	}{
+		{"default stages", retryConfig{Tiers: []int{30}}, false},
+		{"invalid TTL", retryConfig{Tiers: []int{0}}, true},
+		{"duplicate TTL", retryConfig{Tiers: []int{30, 30}}, true},
+		{"unknown stage", retryConfig{Stages: []string{"send"}}, true},
+	}
+
+	for _, tt := range tests {
+		err := tt.cnf.check()
+
+		if tt.err && err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+
+		if !tt.err && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestRetryShard(t *testing.T) {
+	r := newRetryReader()
+
+	if got := r.retryShard(amqp.Table{"x-shard": int32(2)}); got != "messages.2" {
+		t.Errorf("got %q, want the same shard", got)
+	}
+
+	for _, headers := range []amqp.Table{{}, {"x-shard": int32(4)}, {"x-shard": int32(-1)}} {
+		shard := r.retryShard(headers)
+
+		found := false
+		for i := 0; i <= r.config.Rabbit.MaxShard; i++ {
+			if shard == r.shardName(i) {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Errorf("%v: got %q, want one of current shards", headers, shard)
+		}
+	}
+}
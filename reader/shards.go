@@ -0,0 +1,353 @@
+package reader
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"git.aqq.me/go/nanachi"
+	"git.aqq.me/go/retrier"
+	"github.com/streadway/amqp"
+)
+
+// Shards count and orphaned shards check period in seconds by default
+const (
+	defaultShards          = 3
+	defaultRebalancePeriod = 60
+)
+
+// Orphaned shards are scanned up to this count after current shards
+const maxOrphanShards = 1024
+
+// ShardStats holds state of one queue
+type ShardStats struct {
+	Queue     string
+	Messages  int
+	Consumers int
+	// Shard is out of current shards set, left after shards count decrease
+	Orphaned bool
+	// Delayed retry queue
+	Retry bool
+}
+
+// rebalancer periodically drains orphaned shards
+type rebalancer struct {
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// mover publishes messages to current source queue shards. Message is acked
+// only after publish is confirmed.
+type mover struct {
+	producer *nanachi.Producer
+	confirms *nanachi.ConfirmChanNotifier
+	queue    string
+	timeout  time.Duration
+}
+
+// Shards returns depth and consumers count of source queue shards, orphaned
+// shards, retry queues and failed queue
+func (r *Reader) Shards() ([]ShardStats, error) {
+	client, err := r.newClient()
+	if err != nil {
+		return nil, err
+	}
+
+	defer client.Close()
+
+	ch, err := client.NewChannel()
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.declare(ch)
+	ch.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var stats []ShardStats
+
+	for i := 0; i <= r.config.Rabbit.MaxShard; i++ {
+		q, err := inspect(client, r.shardName(i))
+		if err != nil {
+			return nil, err
+		}
+
+		stats = append(stats, ShardStats{Queue: q.Name, Messages: q.Messages, Consumers: q.Consumers})
+	}
+
+	orphans, err := r.orphanShards(client)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, q := range orphans {
+		stats = append(stats, ShardStats{Queue: q.Name, Messages: q.Messages, Consumers: q.Consumers, Orphaned: true})
+	}
+
+	for tier := range r.config.Rabbit.Retry.Tiers {
+		q, err := inspect(client, r.retryQueue(tier))
+		if err != nil {
+			return nil, err
+		}
+
+		stats = append(stats, ShardStats{Queue: q.Name, Messages: q.Messages, Consumers: q.Consumers, Retry: true})
+	}
+
+	q, err := inspect(client, r.config.Rabbit.QueueFailed)
+	if err != nil {
+		return nil, err
+	}
+
+	stats = append(stats, ShardStats{Queue: q.Name, Messages: q.Messages, Consumers: q.Consumers})
+
+	return stats, nil
+}
+
+// startRebalance drains orphaned shards at start and then periodically
+func (r *Reader) startRebalance() {
+	r.rebalance = &rebalancer{stop: make(chan struct{})}
+	r.rebalance.wg.Add(1)
+
+	go func() {
+		defer r.rebalance.wg.Done()
+
+		period := time.Duration(r.config.Rabbit.RebalancePeriod) * time.Second
+
+		for {
+			err := r.drainOrphans(r.rebalance.stop)
+			if err != nil {
+				r.logger.Error("Rebalance failed: ", err)
+			}
+
+			select {
+			case <-r.rebalance.stop:
+				return
+			case <-time.After(period):
+			}
+		}
+	}()
+}
+
+// stopRebalance stops draining and waits, while current message is moved
+func (r *Reader) stopRebalance() {
+	if r.rebalance == nil {
+		return
+	}
+
+	close(r.rebalance.stop)
+	r.rebalance.wg.Wait()
+	r.rebalance = nil
+}
+
+// drainOrphans moves messages from orphaned shards to current shards until
+// orphaned shards are empty
+func (r *Reader) drainOrphans(stop <-chan struct{}) error {
+	orphans, err := r.orphanShards(r.producerClient)
+	if err != nil || len(orphans) == 0 {
+		return err
+	}
+
+	ch, err := r.producerClient.NewChannel()
+	if err != nil {
+		return err
+	}
+
+	// All not acked messages are returned to queue on close
+	defer ch.Close()
+
+	mv := r.newMover(r.producerClient, r.config.Rabbit.Queue, r.config.Rabbit.MaxShard, time.Duration(r.config.Rabbit.ConfirmTimeout)*time.Second)
+	defer mv.producer.Close()
+
+	for j, q := range orphans {
+		// Orphaned shards go right after current shards
+		err = r.unbind(ch, r.config.Rabbit.MaxShard+1+j)
+		if err != nil {
+			return err
+		}
+
+		moved := 0
+
+		for {
+			select {
+			case <-stop:
+				r.logger.Infof("Moved %d messages from orphaned shard %s", moved, q.Name)
+				return nil
+			default:
+			}
+
+			msg, ok, err := ch.Get(q.Name, false)
+			if err != nil {
+				return err
+			}
+
+			if !ok {
+				break
+			}
+
+			err = mv.move(msg, orphanPublishing(msg))
+			if err != nil {
+				return err
+			}
+
+			moved++
+			rebalanced.Inc(r.name, q.Name)
+		}
+
+		if moved > 0 {
+			r.logger.Infof("Moved %d messages from orphaned shard %s", moved, q.Name)
+		}
+
+		if q.Consumers > 0 {
+			r.logger.Warnf("Orphaned shard %s has %d consumers", q.Name, q.Consumers)
+		}
+	}
+
+	return nil
+}
+
+// orphanShards returns shard queues after current shards set. Shard queues
+// are scanned until first not existing queue.
+func (r *Reader) orphanShards(client *nanachi.Client) ([]amqp.Queue, error) {
+	var orphans []amqp.Queue
+
+	for i := r.config.Rabbit.MaxShard + 1; i <= r.config.Rabbit.MaxShard+maxOrphanShards; i++ {
+		q, err := inspect(client, r.shardName(i))
+		if isNotFound(err) {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		orphans = append(orphans, q)
+	}
+
+	return orphans, nil
+}
+
+func (r *Reader) shardName(i int) string {
+	return fmt.Sprintf("%s.%d", r.config.Rabbit.Queue, i)
+}
+
+func (r *Reader) newClient() (*nanachi.Client, error) {
+	return nanachi.NewClient(
+		nanachi.ClientConfig{
+			URI:           r.config.Rabbit.URI,
+			Heartbeat:     time.Second * 15,
+			ErrorNotifier: r,
+			RetrierConfig: &retrier.Config{
+				RetryPolicy: []time.Duration{time.Second},
+				MaxAttempts: r.config.Rabbit.MaxRetry,
+			},
+		},
+	)
+}
+
+// newMover creates mover to queue, shards of queue are chosen by producer, if
+// maxShard > 0
+func (r *Reader) newMover(client *nanachi.Client, queue string, maxShard int, timeout time.Duration) *mover {
+	confirms := nanachi.NewConfirmChanNotifier(1)
+
+	producer := client.NewProducer(
+		nanachi.ProducerConfig{
+			Destinations: []*nanachi.Destination{
+				{
+					RoutingKey: queue,
+					MaxShard:   int32(maxShard),
+				},
+			},
+			Confirm:           true,
+			PendingBufferSize: 1,
+			ConfirmNotifier:   confirms,
+		},
+	)
+
+	return &mover{
+		producer: producer,
+		confirms: confirms,
+		queue:    queue,
+		timeout:  timeout,
+	}
+}
+
+func (m *mover) move(msg amqp.Delivery, pub amqp.Publishing) error {
+	err := m.producer.Send(
+		nanachi.Publishing{
+			RoutingKey: m.queue,
+			Publishing: pub,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case c := <-m.confirms.C:
+		if !c.Ack {
+			return errors.New("publish not confirmed")
+		}
+	case <-time.After(m.timeout):
+		return errors.New("publish confirmation timeout")
+	}
+
+	return msg.Ack(false)
+}
+
+// orphanPublishing copies message to publish it to current shards set
+func orphanPublishing(msg amqp.Delivery) amqp.Publishing {
+	pub := copyPublishing(msg)
+
+	// Let producer choose shard from current shards set
+	delete(pub.Headers, "x-shard")
+
+	return pub
+}
+
+// copyPublishing copies message with all its properties and headers
+func copyPublishing(msg amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+}
+
+// inspect passively inspects queue on new channel, because channel is closed
+// by server, if queue doesn't exist
+func inspect(client *nanachi.Client, name string) (amqp.Queue, error) {
+	ch, err := client.NewChannel()
+	if err != nil {
+		return amqp.Queue{}, err
+	}
+
+	defer ch.Close()
+
+	return ch.QueueInspect(name)
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*amqp.Error)
+	return ok && e.Code == amqp.NotFound
+}
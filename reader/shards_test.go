@@ -0,0 +1,51 @@
+package reader
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestCopyPublishing(t *testing.T) {
+	msg := amqp.Delivery{
+		Headers:         amqp.Table{"x-shard": int32(1), HeaderStage: StageCommit},
+		ContentType:     "application/json",
+		ContentEncoding: "gzip",
+		DeliveryMode:    amqp.Persistent,
+		MessageId:       "id",
+		Timestamp:       time.Unix(1, 0),
+		AppId:           "billing",
+		Body:            []byte("body"),
+		Redelivered:     true,
+	}
+
+	pub := copyPublishing(msg)
+
+	want := amqp.Publishing{
+		Headers:         amqp.Table{"x-shard": int32(1), HeaderStage: StageCommit},
+		ContentType:     "application/json",
+		ContentEncoding: "gzip",
+		DeliveryMode:    amqp.Persistent,
+		MessageId:       "id",
+		Timestamp:       time.Unix(1, 0),
+		AppId:           "billing",
+		Body:            []byte("body"),
+	}
+
+	if !reflect.DeepEqual(pub, want) {
+		t.Errorf("got %+v, want %+v", pub, want)
+	}
+
+	// Copy of headers is changed, not message headers
+	pub = orphanPublishing(msg)
+
+	if _, ok := pub.Headers["x-shard"]; ok {
+		t.Error("shard is not removed from orphaned message")
+	}
+
+	if _, ok := msg.Headers["x-shard"]; !ok {
+		t.Error("shard is removed from original message")
+	}
+}
@@ -0,0 +1,105 @@
+package reader
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Consumer states
+const (
+	ConsumerIdle      = "idle"
+	ConsumerConsuming = "consuming"
+	ConsumerStopped   = "stopped"
+)
+
+// Default timeout of RabbitMQ probe in seconds
+const defaultPingTimeout = 2
+
+// Status holds RabbitMQ health details
+type Status struct {
+	Accessible  bool       `json:"accessible"`
+	Consumer    string     `json:"consumer"`
+	Error       string     `json:"error,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+type readerState struct {
+	m           sync.Mutex
+	consumer    string
+	lastError   string
+	lastErrorAt time.Time
+}
+
+func (s *readerState) setConsumer(state string) {
+	s.m.Lock()
+	s.consumer = state
+	s.m.Unlock()
+}
+
+func (s *readerState) setError(err error) {
+	s.m.Lock()
+	s.lastError = err.Error()
+	s.lastErrorAt = time.Now()
+	s.m.Unlock()
+}
+
+// Status checks RabbitMQ with channel probe and returns it with consumer state
+func (r *Reader) Status() Status {
+	err := r.ping()
+
+	r.state.m.Lock()
+	defer r.state.m.Unlock()
+
+	st := Status{
+		Accessible: err == nil,
+		Consumer:   r.state.consumer,
+		LastError:  r.state.lastError,
+	}
+
+	if err != nil {
+		st.Error = err.Error()
+	}
+
+	if !r.state.lastErrorAt.IsZero() {
+		at := r.state.lastErrorAt
+		st.LastErrorAt = &at
+	}
+
+	return st
+}
+
+// ping opens channel and inspects failed queue. Fails, if consumer is not
+// consuming or RabbitMQ doesn't respond in time.
+func (r *Reader) ping() error {
+	r.state.m.Lock()
+	consumer := r.state.consumer
+	r.state.m.Unlock()
+
+	if consumer != ConsumerConsuming {
+		return errors.New("consumer is " + consumer)
+	}
+
+	res := make(chan error, 1)
+
+	go func() {
+		ch, err := r.producerClient.NewChannel()
+		if err != nil {
+			res <- err
+			return
+		}
+
+		defer ch.Close()
+
+		_, err = ch.QueueInspect(r.config.Rabbit.QueueFailed)
+		res <- err
+	}()
+
+	select {
+	case err := <-res:
+		return err
+	case <-time.After(time.Duration(r.config.Rabbit.PingTimeout) * time.Second):
+		return errors.New("ping timeout")
+	}
+}
@@ -0,0 +1,211 @@
+package reader
+
+import (
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// Exchange types
+const (
+	ExchangeDirect         = "direct"
+	ExchangeTopic          = "topic"
+	ExchangeFanout         = "fanout"
+	ExchangeConsistentHash = "x-consistent-hash"
+)
+
+// Queue types
+const (
+	QueueClassic = "classic"
+	QueueQuorum  = "quorum"
+)
+
+type exchangeConfig struct {
+	Name string
+	Type string
+}
+
+type queueArgsConfig struct {
+	// classic or quorum
+	Type string
+	Lazy bool
+	// Maximum number of messages and size of message bodies, 0 - no limit
+	MaxLength      int64
+	MaxLengthBytes int64
+	// drop-head, reject-publish or reject-publish-dlx
+	Overflow string
+}
+
+// checkTopology validates exchanges and queue arguments and sets defaults
+func (c *rabbitConfig) checkTopology() error {
+	if c.Exchange.Name != "" {
+		if c.Exchange.Type == "" {
+			c.Exchange.Type = ExchangeDirect
+		}
+
+		switch c.Exchange.Type {
+		case ExchangeDirect, ExchangeTopic, ExchangeConsistentHash:
+		default:
+			// Fanout copies every message to every shard
+			return fmt.Errorf("unsupported exchange type %q", c.Exchange.Type)
+		}
+	}
+
+	if c.FailedExchange.Name != "" {
+		if c.FailedExchange.Type == "" {
+			c.FailedExchange.Type = ExchangeFanout
+		}
+
+		switch c.FailedExchange.Type {
+		case ExchangeDirect, ExchangeTopic, ExchangeFanout:
+		default:
+			return fmt.Errorf("unsupported failed exchange type %q", c.FailedExchange.Type)
+		}
+	}
+
+	err := c.QueueArgs.check()
+	if err != nil {
+		return fmt.Errorf("queueArgs: %v", err)
+	}
+
+	err = c.FailedQueueArgs.check()
+	if err != nil {
+		return fmt.Errorf("failedQueueArgs: %v", err)
+	}
+
+	err = c.Retry.check()
+	if err != nil {
+		return fmt.Errorf("retry: %v", err)
+	}
+
+	return nil
+}
+
+func (c queueArgsConfig) check() error {
+	switch c.Type {
+	case "", QueueClassic, QueueQuorum:
+	default:
+		return fmt.Errorf("unsupported queue type %q", c.Type)
+	}
+
+	switch c.Overflow {
+	case "", "drop-head", "reject-publish":
+	case "reject-publish-dlx":
+		if c.Type == QueueQuorum {
+			return fmt.Errorf("overflow %q is not supported by quorum queues", c.Overflow)
+		}
+	default:
+		return fmt.Errorf("unsupported overflow %q", c.Overflow)
+	}
+
+	if c.Lazy && c.Type == QueueQuorum {
+		return fmt.Errorf("lazy mode is not supported by quorum queues")
+	}
+
+	return nil
+}
+
+// table returns arguments of queue declare
+func (c queueArgsConfig) table() amqp.Table {
+	args := amqp.Table{}
+
+	// Not set for classic queues, to redeclare queues, declared without type
+	if c.Type == QueueQuorum {
+		args["x-queue-type"] = c.Type
+	}
+
+	if c.Lazy {
+		args["x-queue-mode"] = "lazy"
+	}
+
+	if c.MaxLength > 0 {
+		args["x-max-length"] = c.MaxLength
+	}
+
+	if c.MaxLengthBytes > 0 {
+		args["x-max-length-bytes"] = c.MaxLengthBytes
+	}
+
+	if c.Overflow != "" {
+		args["x-overflow"] = c.Overflow
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+
+	return args
+}
+
+// declare declares shard queues, failed queue and retry queues with their
+// exchanges and bindings. Queues must be recreated, if their arguments are changed.
+func (r *Reader) declare(ch *amqp.Channel) error {
+	cnf := r.config.Rabbit
+
+	if cnf.Exchange.Name != "" {
+		err := ch.ExchangeDeclare(cnf.Exchange.Name, cnf.Exchange.Type, true, false, false, false, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i <= cnf.MaxShard; i++ {
+		_, err := ch.QueueDeclare(r.shardName(i), true, false, false, false, cnf.QueueArgs.table())
+		if err != nil {
+			return err
+		}
+
+		if cnf.Exchange.Name == "" {
+			continue
+		}
+
+		err = ch.QueueBind(r.shardName(i), r.bindingKey(i), cnf.Exchange.Name, false, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := ch.QueueDeclare(cnf.QueueFailed, true, false, false, false, cnf.FailedQueueArgs.table())
+	if err != nil {
+		return err
+	}
+
+	if cnf.FailedExchange.Name != "" {
+		err = ch.ExchangeDeclare(cnf.FailedExchange.Name, cnf.FailedExchange.Type, true, false, false, false, nil)
+		if err != nil {
+			return err
+		}
+
+		err = ch.QueueBind(cnf.QueueFailed, cnf.QueueFailed, cnf.FailedExchange.Name, false, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.declareRetry(ch)
+}
+
+// unbind removes binding of orphaned shard, so producers don't publish to it
+// through exchange anymore
+func (r *Reader) unbind(ch *amqp.Channel, i int) error {
+	if r.config.Rabbit.Exchange.Name == "" {
+		return nil
+	}
+
+	return ch.QueueUnbind(r.shardName(i), r.bindingKey(i), r.config.Rabbit.Exchange.Name, nil)
+}
+
+// bindingKey returns key of binding of shard queue to exchange. With direct
+// and topic exchanges producers choose shard by routing key, like with
+// default exchange. Consistent hash exchange gets the same weight for every
+// shard.
+func (r *Reader) bindingKey(i int) string {
+	switch r.config.Rabbit.Exchange.Type {
+	case ExchangeTopic:
+		return r.shardName(i) + ".#"
+	case ExchangeConsistentHash:
+		return "1"
+	}
+
+	return r.shardName(i)
+}
@@ -7,15 +7,50 @@ import (
 
 // Reader hold object
 type Reader struct {
+	name           string
 	logger         *zap.SugaredLogger
 	config         readerConfig
 	consumerClient *nanachi.Client
 	producerClient *nanachi.Client
 	consumer       *nanachi.Consumer
 	producer       *nanachi.SmartProducer
+	host           string
+	state          *readerState
+	confirms       *confirms
+	rebalance      *rebalancer
 	C              <-chan *nanachi.Delivery
 }
 
+// Failure describes, why message was moved to failed queue
+type Failure struct {
+	Stage string
+	Code  int32
+	Error string
+}
+
+// Processing stages, where message can fail
+const (
+	StageDecode  = "decode"
+	StagePolicy  = "policy"
+	StagePrepare = "prepare"
+	StageExec    = "exec"
+	StageCommit  = "commit"
+)
+
+// Headers of failed messages
+const (
+	HeaderStage          = "x-corrie-stage"
+	HeaderErrorCode      = "x-corrie-error-code"
+	HeaderError          = "x-corrie-error"
+	HeaderQueue          = "x-corrie-queue"
+	HeaderMessageID      = "x-corrie-message-id"
+	HeaderFirstFailedAt  = "x-corrie-first-failed-at"
+	HeaderLastFailedAt   = "x-corrie-last-failed-at"
+	HeaderHost           = "x-corrie-host"
+	HeaderAttempts       = "x-corrie-attempts"
+	HeaderOriginalHeader = "x-corrie-original-headers"
+)
+
 type readerConfig struct {
 	Rabbit rabbitConfig
 	Batch  int
@@ -25,6 +60,23 @@ type rabbitConfig struct {
 	URI         string
 	Queue       string
 	QueueFailed string
-	MaxShard    int
-	MaxRetry    int
+	// Count of source queue shards
+	Shards int
+	// Deprecated, use Shards
+	MaxShard int
+	MaxRetry int
+	// Timeout of health probe in seconds
+	PingTimeout int
+	// Timeout of failed queue publish confirm in seconds
+	ConfirmTimeout int
+	// Period of orphaned shards check in seconds
+	RebalancePeriod int
+	// Exchange, bound to shard queues, and exchange, bound to failed queue
+	Exchange       exchangeConfig
+	FailedExchange exchangeConfig
+	// Arguments of shard queues and failed queue
+	QueueArgs       queueArgsConfig
+	FailedQueueArgs queueArgsConfig
+	// Delayed retry queues before failed queue
+	Retry retryConfig
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"git.aqq.me/go/app"
+	"github.com/kak-tus/corrie/pipeline"
+	"github.com/kak-tus/corrie/reader"
+)
+
+// replay moves messages from failed queue back to source queue
+func replay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+
+	query := flags.String("query", "", "replay only messages with query, containing substring")
+	stage := flags.String("stage", "", "replay only messages, failed on stage: decode, policy, prepare, exec or commit")
+	code := flags.Int("code", 0, "replay only messages with ClickHouse error code")
+	limit := flags.Int("limit", 0, "maximum number of replayed messages, 0 - no limit")
+	dryRun := flags.Bool("dry-run", false, "only count matched messages, don't replay")
+	queue := flags.String("queue", "", "queue to replay from, failed queue by default")
+	name := flags.String("pipeline", "", "pipeline name, first pipeline by default")
+	timeout := flags.Duration("timeout", time.Second*10, "publish confirmation timeout")
+
+	flags.Parse(args)
+
+	err := app.Init()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Start failed:", err)
+		os.Exit(1)
+	}
+
+	p, err := pipeline.GetPipeline(*name)
+	if err != nil {
+		app.Stop()
+		fmt.Fprintln(os.Stderr, "Start failed:", err)
+		os.Exit(1)
+	}
+
+	stats, err := p.Reader.Replay(
+		reader.ReplayConfig{
+			Queue:          *queue,
+			Query:          *query,
+			Stage:          *stage,
+			Code:           int32(*code),
+			Limit:          *limit,
+			DryRun:         *dryRun,
+			ConfirmTimeout: *timeout,
+		},
+	)
+
+	fmt.Printf("Scanned %d, matched %d, replayed %d messages\n", stats.Scanned, stats.Matched, stats.Replayed)
+
+	stopErr := app.Stop()
+	if stopErr != nil {
+		fmt.Fprintln(os.Stderr, "Stopped with error:", stopErr)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Replay failed:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"git.aqq.me/go/app"
+	"github.com/kak-tus/corrie/pipeline"
+)
+
+// shards prints depth and consumers count of queues
+func shards(args []string) {
+	flags := flag.NewFlagSet("shards", flag.ExitOnError)
+	name := flags.String("pipeline", "", "pipeline name, first pipeline by default")
+
+	flags.Parse(args)
+
+	err := app.Init()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Start failed:", err)
+		os.Exit(1)
+	}
+
+	p, err := pipeline.GetPipeline(*name)
+	if err != nil {
+		app.Stop()
+		fmt.Fprintln(os.Stderr, "Start failed:", err)
+		os.Exit(1)
+	}
+
+	stats, err := p.Reader.Shards()
+
+	stopErr := app.Stop()
+	if stopErr != nil {
+		fmt.Fprintln(os.Stderr, "Stopped with error:", stopErr)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Shards failed:", err)
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "QUEUE\tMESSAGES\tCONSUMERS\tSTATE")
+
+	for _, st := range stats {
+		state := ""
+		if st.Orphaned {
+			state = "orphaned"
+		} else if st.Retry {
+			state = "retry"
+		}
+
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", st.Queue, st.Messages, st.Consumers, state)
+	}
+
+	w.Flush()
+}
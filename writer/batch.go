@@ -0,0 +1,188 @@
+package writer
+
+import (
+	"container/list"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// batch holds values of one query, not yet handed over to workers
+type batch struct {
+	query string
+	table string
+	vals  []*toSend
+	bytes int
+	el    *list.Element
+	// Maximum number of values
+	size int
+	// Time, when batch must be flushed, counted from its oldest value arrival
+	deadline time.Time
+}
+
+// Period of batches age check
+const expireCheckPeriod = time.Second
+
+// LimitStats holds counters of memory limits hits
+type LimitStats struct {
+	// Number of buffered queries
+	Queries int64
+	// Buffered message bodies size
+	Bytes int64
+	// Batches, flushed because of maximum number of queries
+	QueriesHits int64
+	// Batches, flushed because of maximum batch size in bytes
+	BatchBytesHits int64
+	// Batches, flushed because of maximum total size in bytes
+	BytesHits int64
+}
+
+// add appends rows of one message to query batch. Batch is flushed, if it is
+// full. Least recently used batches are flushed, if memory limits are reached.
+// Rows of message are added together, so batches are cut only on message
+// boundaries.
+func (w *Writer) add(query string, vals []*toSend) {
+	b, ok := w.batches[query]
+
+	if ok {
+		w.lru.MoveToBack(b.el)
+	} else {
+		if w.config.MaxQueries > 0 && len(w.batches) >= w.config.MaxQueries {
+			oldest := w.lru.Front().Value.(*batch)
+
+			w.logger.Infof("Maximum number of queries %d reached, flush %q", w.config.MaxQueries, oldest.query)
+			atomic.AddInt64(&w.limits.QueriesHits, 1)
+
+			w.sendOne(oldest.query)
+		}
+
+		size, maxAge := w.tableLimits(query)
+
+		b = &batch{
+			query:    query,
+			table:    tableLabel(query),
+			size:     size,
+			deadline: time.Now().Add(jitter(maxAge)),
+		}
+
+		b.el = w.lru.PushBack(b)
+		w.batches[query] = b
+	}
+
+	for _, v := range vals {
+		b.vals = append(b.vals, v)
+		b.bytes += v.size
+		w.bytes += v.size
+		w.values++
+		w.state.added(b.table)
+	}
+
+	w.updateLimitStats()
+
+	if len(b.vals) >= b.size {
+		w.sendOne(query)
+	} else if w.config.MaxBatchBytes > 0 && b.bytes >= w.config.MaxBatchBytes {
+		w.logger.Infof("Maximum batch size %d bytes reached for %q", w.config.MaxBatchBytes, query)
+		atomic.AddInt64(&w.limits.BatchBytesHits, 1)
+
+		w.sendOne(query)
+	}
+
+	for w.config.MaxBytes > 0 && w.bytes >= w.config.MaxBytes && w.lru.Len() > 0 {
+		oldest := w.lru.Front().Value.(*batch)
+
+		w.logger.Infof("Maximum total size %d bytes reached, flush %q", w.config.MaxBytes, oldest.query)
+		atomic.AddInt64(&w.limits.BytesHits, 1)
+
+		w.sendOne(oldest.query)
+	}
+}
+
+// sendExpired hands batches, which oldest values are waiting too long, over to
+// flush workers
+func (w *Writer) sendExpired() {
+	now := time.Now()
+
+	for query, b := range w.batches {
+		if now.After(b.deadline) {
+			w.sendOne(query)
+		}
+	}
+}
+
+// tableLimits returns batch size and maximum age of query table batches
+func (w *Writer) tableLimits(query string) (int, time.Duration) {
+	size := w.config.Batch
+	maxAge := w.config.Period
+
+	parsed, err := parseInsert(query)
+	if err == nil {
+		cnf, ok := w.config.Tables[parsed.Database+"."+parsed.Table]
+		if ok {
+			if cnf.Batch > 0 {
+				size = cnf.Batch
+			}
+
+			if cnf.MaxAge > 0 {
+				maxAge = cnf.MaxAge
+			}
+		}
+	}
+
+	return size, time.Duration(maxAge) * time.Second
+}
+
+// jitter shortens maximum age by random value up to 10%, to spread flushes of
+// batches, started at the same moment
+func jitter(maxAge time.Duration) time.Duration {
+	spread := int64(maxAge / 10)
+	if spread <= 0 {
+		return maxAge
+	}
+
+	return maxAge - time.Duration(rand.Int63n(spread))
+}
+
+// sendAll hands all batches over to flush workers
+func (w *Writer) sendAll() {
+	for query := range w.batches {
+		w.sendOne(query)
+	}
+}
+
+// sendOne hands query batch over to flush workers and frees it
+func (w *Writer) sendOne(query string) {
+	b, ok := w.batches[query]
+	if !ok {
+		return
+	}
+
+	delete(w.batches, query)
+	w.lru.Remove(b.el)
+	w.bytes -= b.bytes
+	w.values -= len(b.vals)
+
+	w.updateLimitStats()
+
+	w.enqueue(query, b.table, b.vals)
+}
+
+func (w *Writer) updateLimitStats() {
+	atomic.StoreInt64(&w.limits.Queries, int64(len(w.batches)))
+	atomic.StoreInt64(&w.limits.Bytes, int64(w.bytes))
+
+	bufferedQueries.Set(float64(len(w.batches)), w.name)
+	bufferedValues.Set(float64(w.values), w.name)
+	bufferedBytes.Set(float64(w.bytes), w.name)
+}
+
+// Limits returns counters of memory limits
+func (w *Writer) Limits() LimitStats {
+	return LimitStats{
+		Queries:        atomic.LoadInt64(&w.limits.Queries),
+		Bytes:          atomic.LoadInt64(&w.limits.Bytes),
+		QueriesHits:    atomic.LoadInt64(&w.limits.QueriesHits),
+		BatchBytesHits: atomic.LoadInt64(&w.limits.BatchBytesHits),
+		BytesHits:      atomic.LoadInt64(&w.limits.BytesHits),
+	}
+}
@@ -0,0 +1,47 @@
+package writer
+
+import (
+	"container/list"
+	"strconv"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestAddKeepsMessageRows(t *testing.T) {
+	w := &Writer{
+		logger:   zap.NewNop().Sugar(),
+		config:   writerConfig{Batch: 2, Period: 60},
+		batches:  make(map[string]*batch),
+		lru:      list.New(),
+		pool:     newPool(1),
+		inFlight: make(chan struct{}, 10),
+		abandon:  make(chan struct{}),
+		state:    &writerState{tables: make(map[string]*TableStatus)},
+	}
+
+	d := &delivery{id: "a", rows: 3}
+	vals := make([]*toSend, 3)
+
+	for i := range vals {
+		vals[i] = &toSend{id: rowID("a", i, 3), delivery: d, row: i}
+	}
+
+	w.add(testQuery, vals)
+
+	// Batch is full, but is flushed only after the last row of message
+	j := w.pool.next()
+	if len(j.vals) != 3 {
+		t.Fatalf("got batch of %d rows, want all 3 rows of message", len(j.vals))
+	}
+
+	for i, v := range j.vals {
+		if v.id != "a#"+strconv.Itoa(i) {
+			t.Errorf("got row %s at %d", v.id, i)
+		}
+	}
+
+	if len(w.batches) != 0 || w.values != 0 {
+		t.Errorf("got %d batches and %d values left", len(w.batches), w.values)
+	}
+}
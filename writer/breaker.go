@@ -0,0 +1,262 @@
+package writer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kak-tus/corrie/reader"
+)
+
+// Default period of parked tables probe in seconds
+const defaultProbeInterval = 30
+
+type breakerConfig struct {
+	// Consecutive prepare or schema failures of table, after which inserts to
+	// table are stopped and its messages are parked. 0 - disabled.
+	Threshold int
+	// Period of parked tables probe in seconds
+	ProbeInterval int
+	// Replay parked messages automatically, when table is back
+	Replay bool
+}
+
+// circuit holds breaker state of table
+type circuit struct {
+	failures int
+	open     bool
+	openedAt time.Time
+	// Query to probe table columns
+	query string
+}
+
+// breaker stops inserts to tables, which fail consecutively on prepare or
+// with schema errors, like dropped or renamed tables
+type breaker struct {
+	threshold int
+	circuits  map[string]*circuit
+	m         *sync.Mutex
+	stop      chan struct{}
+	wg        *sync.WaitGroup
+}
+
+func newBreaker(cnf breakerConfig) *breaker {
+	return &breaker{
+		threshold: cnf.Threshold,
+		circuits:  make(map[string]*circuit),
+		m:         &sync.Mutex{},
+		stop:      make(chan struct{}),
+		wg:        &sync.WaitGroup{},
+	}
+}
+
+// isOpen checks, if inserts to table are stopped
+func (b *breaker) isOpen(table string) bool {
+	if b.threshold <= 0 {
+		return false
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	c, ok := b.circuits[table]
+	return ok && c.open
+}
+
+// update counts consecutive failures of table after batch is sent. Returns
+// true, if breaker is opened by this batch.
+func (b *breaker) update(table, query string, vals []*toSend) bool {
+	// Not parsed queries can't be probed
+	if b.threshold <= 0 || table == unknownTable {
+		return false
+	}
+
+	failed := isTargetFailure(vals)
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	c, ok := b.circuits[table]
+
+	if !failed {
+		if ok && !c.open {
+			delete(b.circuits, table)
+		}
+
+		return false
+	}
+
+	if !ok {
+		c = &circuit{}
+		b.circuits[table] = c
+	}
+
+	if c.open {
+		return false
+	}
+
+	c.failures++
+	c.query = query
+
+	if c.failures < b.threshold {
+		return false
+	}
+
+	c.open = true
+	c.openedAt = time.Now()
+
+	return true
+}
+
+// opened returns tables with stopped inserts and queries to probe them
+func (b *breaker) opened() map[string]string {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	tables := make(map[string]string)
+
+	for table, c := range b.circuits {
+		if c.open {
+			tables[table] = c.query
+		}
+	}
+
+	return tables
+}
+
+// openedSince returns tables with stopped inserts and time, when they are
+// stopped
+func (b *breaker) openedSince() map[string]time.Time {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	tables := make(map[string]time.Time)
+
+	for table, c := range b.circuits {
+		if c.open {
+			tables[table] = c.openedAt
+		}
+	}
+
+	return tables
+}
+
+func (b *breaker) close(table string) {
+	b.m.Lock()
+	delete(b.circuits, table)
+	b.m.Unlock()
+}
+
+// isTargetFailure checks, if all values of batch failed, because table can't
+// be written: table or its columns are not found or query prepare failed with
+// ClickHouse error. Network errors and timeouts are failures of ClickHouse, not
+// of table.
+func isTargetFailure(vals []*toSend) bool {
+	for _, v := range vals {
+		if !v.failed {
+			return false
+		}
+
+		switch v.class {
+		case classUnknownTable, classUnknownColumn, classTypeMismatch:
+			continue
+		case classOther:
+			// Prepare fails, if table has columns, not supported by driver
+			if v.failure.Stage == reader.StagePrepare {
+				continue
+			}
+		}
+
+		return false
+	}
+
+	return len(vals) > 0
+}
+
+// park marks not sent values to move them to parking queue of table instead
+// of failed queue
+func park(table string, vals []*toSend) {
+	for _, v := range vals {
+		if v.sent {
+			continue
+		}
+
+		if !v.failed {
+			v.failure = reader.Failure{
+				Stage: reader.StagePrepare,
+				Error: "inserts to table " + table + " are stopped",
+			}
+		}
+
+		v.failed = false
+		v.parked = true
+	}
+}
+
+// startProbe periodically checks tables with stopped inserts and resumes
+// inserts, if table and all query columns are found
+func (w *Writer) startProbe() {
+	if w.breaker.threshold <= 0 {
+		return
+	}
+
+	interval := time.Duration(w.config.Breaker.ProbeInterval) * time.Second
+
+	w.breaker.wg.Add(1)
+
+	go func() {
+		defer w.breaker.wg.Done()
+
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+
+		for {
+			select {
+			case <-w.breaker.stop:
+				return
+			case <-tick.C:
+			}
+
+			for table, query := range w.breaker.opened() {
+				w.probe(table, query)
+			}
+		}
+	}()
+}
+
+// stopProbe stops probe and waits, while current probe is finished
+func (w *Writer) stopProbe() {
+	close(w.breaker.stop)
+	w.breaker.wg.Wait()
+}
+
+func (w *Writer) probe(table, query string) {
+	w.resetSchema(query)
+
+	if w.columnTypes(query) == nil {
+		w.logger.Infof("Table %s is still not writable, messages are parked", table)
+		return
+	}
+
+	w.breaker.close(table)
+	breakerOpen.Set(0, w.name, table)
+
+	queue := w.reader.ParkingQueue(table)
+
+	if !w.config.Breaker.Replay {
+		w.logger.Infof(
+			"Table %s is back, resume inserts. Replay parked messages with: corrie replay -pipeline %s -queue %s",
+			table, w.name, queue,
+		)
+
+		return
+	}
+
+	w.logger.Infof("Table %s is back, resume inserts and replay parked messages from %s", table, queue)
+
+	stats, err := w.reader.Replay(reader.ReplayConfig{Queue: queue})
+	if err != nil {
+		w.logger.Error("Replay failed: ", err)
+	}
+
+	w.logger.Infof("Replayed %d parked messages of table %s", stats.Replayed, table)
+}
@@ -0,0 +1,119 @@
+package writer
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/kak-tus/corrie/reader"
+)
+
+func failedValue(stage string, err error) *toSend {
+	v := &toSend{}
+	v.fail(&stageError{stage: stage, err: err})
+
+	return v
+}
+
+func TestIsTargetFailure(t *testing.T) {
+	unknownTable := &clickhouse.Exception{Code: 60}
+
+	tests := []struct {
+		name   string
+		vals   []*toSend
+		target bool
+	}{
+		{"unknown table", []*toSend{failedValue(reader.StageExec, unknownTable), failedValue(reader.StageCommit, unknownTable)}, true},
+		{"prepare failed", []*toSend{failedValue(reader.StagePrepare, errors.New("unsupported column type"))}, true},
+		{"prepare exception", []*toSend{failedValue(reader.StagePrepare, &clickhouse.Exception{Code: 1})}, true},
+		{"some values sent", []*toSend{failedValue(reader.StagePrepare, unknownTable), {sent: true}}, false},
+		{"syntax error", []*toSend{failedValue(reader.StagePrepare, &clickhouse.Exception{Code: 62})}, false},
+		{"network exception", []*toSend{failedValue(reader.StagePrepare, &clickhouse.Exception{Code: 210})}, false},
+		{"network error on begin", []*toSend{failedValue(reader.StagePrepare, io.EOF)}, false},
+		{"timeout on begin", []*toSend{failedValue(reader.StagePrepare, timeoutError{timeout: true})}, false},
+		{"other error on commit", []*toSend{failedValue(reader.StageCommit, errors.New("unknown"))}, false},
+		{"row error", []*toSend{failedValue(reader.StageCommit, &clickhouse.Exception{Code: 27})}, false},
+		{"empty batch", nil, false},
+	}
+
+	for _, tt := range tests {
+		if isTargetFailure(tt.vals) != tt.target {
+			t.Errorf("%s: want target failure %v", tt.name, tt.target)
+		}
+	}
+}
+
+func TestBreakerUpdate(t *testing.T) {
+	b := newBreaker(breakerConfig{Threshold: 2})
+
+	failedBatch := []*toSend{failedValue(reader.StagePrepare, &clickhouse.Exception{Code: 60})}
+	sentBatch := []*toSend{{sent: true}}
+
+	if b.update("db.t", "q1", failedBatch) || b.isOpen("db.t") {
+		t.Fatal("breaker is opened before threshold")
+	}
+
+	// Successful batch resets consecutive failures
+	b.update("db.t", "q1", sentBatch)
+
+	if b.update("db.t", "q1", failedBatch) {
+		t.Fatal("breaker is opened after failures are reset")
+	}
+
+	if !b.update("db.t", "q2", failedBatch) || !b.isOpen("db.t") {
+		t.Fatal("breaker is not opened at threshold")
+	}
+
+	// Opened breaker is reported once and is not closed by batch
+	if b.update("db.t", "q2", failedBatch) {
+		t.Error("breaker is opened twice")
+	}
+
+	b.update("db.t", "q2", sentBatch)
+
+	if q := b.opened()["db.t"]; q != "q2" {
+		t.Errorf("got probe query %q, want last failed query", q)
+	}
+
+	if b.isOpen("db.other") {
+		t.Error("breaker of other table is opened")
+	}
+
+	b.close("db.t")
+
+	if b.isOpen("db.t") {
+		t.Error("breaker is not closed")
+	}
+
+	// Not parsed queries and disabled breaker are not counted
+	if b.update(unknownTable, "q", failedBatch) || b.update(unknownTable, "q", failedBatch) {
+		t.Error("breaker is opened for not parsed query")
+	}
+
+	disabled := newBreaker(breakerConfig{})
+
+	if disabled.update("db.t", "q", failedBatch) || disabled.isOpen("db.t") {
+		t.Error("disabled breaker is opened")
+	}
+}
+
+func TestPark(t *testing.T) {
+	sent := &toSend{sent: true}
+	failed := failedValue(reader.StagePrepare, &clickhouse.Exception{Code: 60})
+	pending := &toSend{}
+
+	park("db.t", []*toSend{sent, failed, pending})
+
+	if sent.parked {
+		t.Error("sent value is parked")
+	}
+
+	if !failed.parked || failed.failed || failed.failure.Code != 60 {
+		t.Errorf("failed value is not parked with its failure: %+v", failed)
+	}
+
+	if !pending.parked || pending.failed || pending.failure.Stage != reader.StagePrepare {
+		t.Errorf("pending value is not parked: %+v", pending)
+	}
+}
@@ -0,0 +1,382 @@
+package writer
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/ClickHouse/clickhouse-go/lib/data"
+)
+
+var selectRe = regexp.MustCompile(`(?i)\sSELECT\s`)
+
+// columnWriter writes value, converted according to column type, to column of
+// native block with typed write method of driver
+type columnWriter func(block *data.Block, c int, v interface{}) error
+
+// blockColumn holds converted values of column and writer for them
+type blockColumn struct {
+	write columnWriter
+	vals  []interface{}
+}
+
+var columnWriters = map[string]columnWriter{
+	"Int8": func(block *data.Block, c int, v interface{}) error {
+		return block.WriteInt8(c, v.(int8))
+	},
+	"Int16": func(block *data.Block, c int, v interface{}) error {
+		return block.WriteInt16(c, v.(int16))
+	},
+	"Int32": func(block *data.Block, c int, v interface{}) error {
+		return block.WriteInt32(c, v.(int32))
+	},
+	"Int64": func(block *data.Block, c int, v interface{}) error {
+		return block.WriteInt64(c, v.(int64))
+	},
+	"UInt8": func(block *data.Block, c int, v interface{}) error {
+		return block.WriteUInt8(c, v.(uint8))
+	},
+	"UInt16": func(block *data.Block, c int, v interface{}) error {
+		return block.WriteUInt16(c, v.(uint16))
+	},
+	"UInt32": func(block *data.Block, c int, v interface{}) error {
+		return block.WriteUInt32(c, v.(uint32))
+	},
+	"UInt64": func(block *data.Block, c int, v interface{}) error {
+		return block.WriteUInt64(c, v.(uint64))
+	},
+	"Float32": func(block *data.Block, c int, v interface{}) error {
+		return block.WriteFloat32(c, v.(float32))
+	},
+	"Float64": func(block *data.Block, c int, v interface{}) error {
+		return block.WriteFloat64(c, v.(float64))
+	},
+	"String": func(block *data.Block, c int, v interface{}) error {
+		return block.WriteString(c, v.(string))
+	},
+	"Date": func(block *data.Block, c int, v interface{}) error {
+		return block.WriteDate(c, v.(time.Time))
+	},
+	"DateTime": func(block *data.Block, c int, v interface{}) error {
+		return block.WriteDateTime(c, v.(time.Time))
+	},
+	"IPv4": writeIP,
+	"IPv6": writeIP,
+}
+
+var nullableWriters = map[string]columnWriter{
+	"Int8": func(block *data.Block, c int, v interface{}) error {
+		if v == nil {
+			return block.WriteInt8Nullable(c, nil)
+		}
+
+		n := v.(int8)
+		return block.WriteInt8Nullable(c, &n)
+	},
+	"Int16": func(block *data.Block, c int, v interface{}) error {
+		if v == nil {
+			return block.WriteInt16Nullable(c, nil)
+		}
+
+		n := v.(int16)
+		return block.WriteInt16Nullable(c, &n)
+	},
+	"Int32": func(block *data.Block, c int, v interface{}) error {
+		if v == nil {
+			return block.WriteInt32Nullable(c, nil)
+		}
+
+		n := v.(int32)
+		return block.WriteInt32Nullable(c, &n)
+	},
+	"Int64": func(block *data.Block, c int, v interface{}) error {
+		if v == nil {
+			return block.WriteInt64Nullable(c, nil)
+		}
+
+		n := v.(int64)
+		return block.WriteInt64Nullable(c, &n)
+	},
+	"UInt8": func(block *data.Block, c int, v interface{}) error {
+		if v == nil {
+			return block.WriteUInt8Nullable(c, nil)
+		}
+
+		n := v.(uint8)
+		return block.WriteUInt8Nullable(c, &n)
+	},
+	"UInt16": func(block *data.Block, c int, v interface{}) error {
+		if v == nil {
+			return block.WriteUInt16Nullable(c, nil)
+		}
+
+		n := v.(uint16)
+		return block.WriteUInt16Nullable(c, &n)
+	},
+	"UInt32": func(block *data.Block, c int, v interface{}) error {
+		if v == nil {
+			return block.WriteUInt32Nullable(c, nil)
+		}
+
+		n := v.(uint32)
+		return block.WriteUInt32Nullable(c, &n)
+	},
+	"UInt64": func(block *data.Block, c int, v interface{}) error {
+		if v == nil {
+			return block.WriteUInt64Nullable(c, nil)
+		}
+
+		n := v.(uint64)
+		return block.WriteUInt64Nullable(c, &n)
+	},
+	"Float32": func(block *data.Block, c int, v interface{}) error {
+		if v == nil {
+			return block.WriteFloat32Nullable(c, nil)
+		}
+
+		f := v.(float32)
+		return block.WriteFloat32Nullable(c, &f)
+	},
+	"Float64": func(block *data.Block, c int, v interface{}) error {
+		if v == nil {
+			return block.WriteFloat64Nullable(c, nil)
+		}
+
+		f := v.(float64)
+		return block.WriteFloat64Nullable(c, &f)
+	},
+	"String": func(block *data.Block, c int, v interface{}) error {
+		if v == nil {
+			return block.WriteStringNullable(c, nil)
+		}
+
+		str := v.(string)
+		return block.WriteStringNullable(c, &str)
+	},
+	"Date": func(block *data.Block, c int, v interface{}) error {
+		if v == nil {
+			return block.WriteDateNullable(c, nil)
+		}
+
+		tm := v.(time.Time)
+		return block.WriteDateNullable(c, &tm)
+	},
+	"DateTime": func(block *data.Block, c int, v interface{}) error {
+		if v == nil {
+			return block.WriteDateTimeNullable(c, nil)
+		}
+
+		tm := v.(time.Time)
+		return block.WriteDateTimeNullable(c, &tm)
+	},
+}
+
+func writeIP(block *data.Block, c int, v interface{}) error {
+	return block.WriteIP(c, v.(net.IP))
+}
+
+func writeFixedString(block *data.Block, c int, v interface{}) error {
+	return block.WriteFixedString(c, []byte(v.(string)))
+}
+
+func writeArray(block *data.Block, c int, v interface{}) error {
+	return block.WriteArray(c, v)
+}
+
+// sendColumnar writes batch as one native block through raw driver connection.
+// Values are written column by column with typed write methods of driver,
+// bypassing per row database/sql conversions.
+func (w *Writer) sendColumnar(query string, columns []blockColumn, rows int) error {
+	conn, err := w.getConn()
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Begin()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	// Rollback closes connection too
+	_, err = conn.Prepare(query)
+	if err != nil {
+		conn.Rollback()
+		return err
+	}
+
+	block, err := conn.Block()
+	if err != nil {
+		conn.Rollback()
+		return err
+	}
+
+	block.Reserve()
+
+	err = writeColumns(block, columns, rows)
+	if err != nil {
+		conn.Rollback()
+		return err
+	}
+
+	err = conn.WriteBlock(block)
+	if err != nil {
+		conn.Rollback()
+		return err
+	}
+
+	err = conn.Commit()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	w.putConn(conn)
+
+	return nil
+}
+
+// getConn returns idle raw driver connection or opens new one
+func (w *Writer) getConn() (clickhouse.Clickhouse, error) {
+	select {
+	case conn := <-w.conns:
+		return conn, nil
+	default:
+	}
+
+	return clickhouse.OpenDirect(w.config.ClickhouseURI)
+}
+
+// putConn returns connection to idle pool
+func (w *Writer) putConn(conn clickhouse.Clickhouse) {
+	select {
+	case w.conns <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (w *Writer) closeConns() {
+	for {
+		select {
+		case conn := <-w.conns:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// blockWriter returns typed writer for column type. Returns false, if driver
+// has no typed write method for it, like for Decimal, UUID, Enum and
+// DateTime64 columns.
+func blockWriter(chType string) (columnWriter, bool) {
+	if inner, ok := unwrapType(chType, "LowCardinality"); ok {
+		return blockWriter(inner)
+	}
+
+	if inner, ok := unwrapType(chType, "Nullable"); ok {
+		write, ok := nullableWriters[baseType(inner)]
+		return write, ok
+	}
+
+	if inner, ok := unwrapType(chType, "Array"); ok {
+		if _, ok := blockWriter(inner); !ok {
+			return nil, false
+		}
+
+		return writeArray, true
+	}
+
+	if _, ok := unwrapType(chType, "FixedString"); ok {
+		return writeFixedString, true
+	}
+
+	write, ok := columnWriters[baseType(chType)]
+
+	return write, ok
+}
+
+// baseType returns DateTime for DateTime with time zone. Time zone matters only
+// for parsing of values, written timestamp is the same.
+func baseType(chType string) string {
+	if strings.HasPrefix(chType, "DateTime(") {
+		return "DateTime"
+	}
+
+	return chType
+}
+
+// makeColumns groups batch data by column and converts values according to
+// column types. Returns false, if column types are unknown, some column has no
+// typed writer or some value can't be converted. Such batch is written row by
+// row, so bad values are isolated.
+func makeColumns(query string, chTypes []string, vals []*toSend) ([]blockColumn, bool) {
+	if !isInsert(query) || len(vals) == 0 || len(chTypes) == 0 {
+		return nil, false
+	}
+
+	for _, v := range vals {
+		if len(v.parsed.Data) != len(chTypes) {
+			return nil, false
+		}
+	}
+
+	columns := make([]blockColumn, len(chTypes))
+
+	for i, chType := range chTypes {
+		write, ok := blockWriter(chType)
+		if !ok {
+			return nil, false
+		}
+
+		col := blockColumn{write: write, vals: make([]interface{}, len(vals))}
+
+		for j, v := range vals {
+			conv, err := convert(chType, v.parsed.Data[i])
+			if err != nil {
+				return nil, false
+			}
+
+			col.vals[j] = conv
+		}
+
+		columns[i] = col
+	}
+
+	return columns, true
+}
+
+// writeColumns writes columns to reserved block of prepared insert
+func writeColumns(block *data.Block, columns []blockColumn, rows int) error {
+	if len(block.Columns) != len(columns) {
+		return fmt.Errorf("expected %d columns in block, got %d", len(columns), len(block.Columns))
+	}
+
+	block.NumRows = uint64(rows)
+
+	for c, col := range columns {
+		for _, v := range col.vals {
+			err := col.write(block, c, v)
+			if err != nil {
+				return fmt.Errorf("column %d: %v", c, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func isInsert(query string) bool {
+	f := strings.Fields(query)
+	if len(f) < 3 {
+		return false
+	}
+
+	return strings.EqualFold("INSERT", f[0]) &&
+		strings.EqualFold("INTO", f[1]) &&
+		!selectRe.MatchString(query)
+}
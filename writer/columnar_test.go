@@ -0,0 +1,271 @@
+package writer
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/lib/binary"
+	"github.com/ClickHouse/clickhouse-go/lib/column"
+	"github.com/ClickHouse/clickhouse-go/lib/data"
+	"github.com/kak-tus/corrie/message"
+)
+
+const testQuery = "INSERT INTO db.t (a) VALUES (?)"
+
+func rowValues(rows ...[]interface{}) []*toSend {
+	vals := make([]*toSend, len(rows))
+
+	for i, row := range rows {
+		vals[i] = &toSend{id: strconv.Itoa(i), parsed: message.Message{Query: testQuery, Data: row}}
+	}
+
+	return vals
+}
+
+// newBlock returns reserved block, like driver prepares for insert
+func newBlock(t *testing.T, chTypes []string) *data.Block {
+	block := &data.Block{NumColumns: uint64(len(chTypes))}
+
+	for i, chType := range chTypes {
+		col, err := column.Factory("c"+strconv.Itoa(i), chType, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		block.Columns = append(block.Columns, col)
+	}
+
+	block.Reserve()
+
+	return block
+}
+
+func encodeBlock(t *testing.T, block *data.Block) []byte {
+	var buf bytes.Buffer
+
+	err := block.Write(&data.ServerInfo{}, binary.NewEncoder(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestBlockWriter(t *testing.T) {
+	tests := []struct {
+		chType string
+		ok     bool
+	}{
+		{chType: "Int8", ok: true},
+		{chType: "UInt64", ok: true},
+		{chType: "Float64", ok: true},
+		{chType: "String", ok: true},
+		{chType: "FixedString(16)", ok: true},
+		{chType: "Date", ok: true},
+		{chType: "DateTime", ok: true},
+		{chType: "DateTime('Europe/Moscow')", ok: true},
+		{chType: "IPv4", ok: true},
+		{chType: "IPv6", ok: true},
+		{chType: "Nullable(Int32)", ok: true},
+		{chType: "Nullable(DateTime('UTC'))", ok: true},
+		{chType: "LowCardinality(String)", ok: true},
+		{chType: "LowCardinality(Nullable(String))", ok: true},
+		{chType: "Array(String)", ok: true},
+		{chType: "Array(Array(UInt8))", ok: true},
+		{chType: "Array(Decimal(9, 2))", ok: false},
+		{chType: "Nullable(IPv4)", ok: false},
+		{chType: "Decimal(9, 2)", ok: false},
+		{chType: "UUID", ok: false},
+		{chType: "Enum8('a' = 1)", ok: false},
+		{chType: "DateTime64(3)", ok: false},
+		{chType: "Int128", ok: false},
+	}
+
+	for _, tt := range tests {
+		_, ok := blockWriter(tt.chType)
+		if ok != tt.ok {
+			t.Errorf("%s: got %v, want %v", tt.chType, ok, tt.ok)
+		}
+	}
+}
+
+func TestMakeColumns(t *testing.T) {
+	vals := rowValues(
+		[]interface{}{json.Number("1"), "a"},
+		[]interface{}{json.Number("2"), "b"},
+	)
+
+	columns, ok := makeColumns(testQuery, []string{"UInt8", "LowCardinality(String)"}, vals)
+	if !ok {
+		t.Fatal("expected columns")
+	}
+
+	if len(columns) != 2 || len(columns[0].vals) != 2 {
+		t.Fatalf("got %d columns", len(columns))
+	}
+
+	if columns[0].vals[1] != uint8(2) || columns[1].vals[0] != "a" {
+		t.Errorf("got %v and %v", columns[0].vals, columns[1].vals)
+	}
+
+	// Batches, written row by row
+	tests := []struct {
+		name    string
+		query   string
+		chTypes []string
+		vals    []*toSend
+	}{
+		{name: "unknown types", query: testQuery, vals: vals},
+		{name: "not insert", query: "ALTER TABLE db.t DELETE WHERE a = ?", chTypes: []string{"UInt8", "String"}, vals: vals},
+		{name: "no typed writer", query: testQuery, chTypes: []string{"UInt8", "UUID"}, vals: vals},
+		{name: "wrong width", query: testQuery, chTypes: []string{"UInt8"}, vals: vals},
+		{name: "bad value", query: testQuery, chTypes: []string{"Int8", "Int8"}, vals: vals},
+		{name: "no values", query: testQuery, chTypes: []string{"UInt8", "String"}},
+	}
+
+	for _, tt := range tests {
+		_, ok := makeColumns(tt.query, tt.chTypes, tt.vals)
+		if ok {
+			t.Errorf("%s: expected row by row fallback", tt.name)
+		}
+	}
+}
+
+// Typed writers must write the same block, as driver writes row by row. Under
+// NULL dates driver writes its own default value, so they are not compared.
+func TestWriteColumns(t *testing.T) {
+	chTypes := []string{
+		"Int8", "Int16", "Int32", "Int64", "UInt8", "UInt16", "UInt32", "UInt64",
+		"Float32", "Float64", "String", "FixedString(3)", "Date", "DateTime",
+		"DateTime('Europe/Moscow')", "IPv4", "IPv6",
+		"Nullable(Int8)", "Nullable(UInt64)", "Nullable(Float64)", "Nullable(String)",
+		"Nullable(Date)", "Nullable(DateTime)",
+		"Array(String)", "Array(Array(UInt8))",
+	}
+
+	vals := rowValues(
+		[]interface{}{
+			json.Number("-1"), json.Number("-2"), json.Number("-3"), json.Number("-4"),
+			json.Number("1"), json.Number("2"), json.Number("3"), json.Number("18446744073709551615"),
+			json.Number("1.5"), json.Number("2.5"), "a", "abc", "2019-03-04", "2019-03-04 05:06:07",
+			"2019-03-04 08:06:07", "10.0.0.1", "::1",
+			json.Number("1"), json.Number("2"), json.Number("3.5"), "b",
+			"2019-03-05", "2019-03-05 05:06:07",
+			[]interface{}{"x", "y"}, []interface{}{[]interface{}{json.Number("1")}, []interface{}{}},
+		},
+		[]interface{}{
+			int64(1), int64(2), int64(3), int64(4),
+			uint64(5), uint64(6), uint64(7), uint64(8),
+			float64(0.25), float64(0.5), []byte("c"), "def", int64(1551657600), int64(1551675967),
+			"2019-03-04T05:06:07Z", []byte{10, 0, 0, 2}, "fe80::1",
+			nil, nil, nil, nil,
+			int64(1551744000), int64(1551762367),
+			[]interface{}{}, []interface{}{},
+		},
+	)
+
+	columns, ok := makeColumns(testQuery, chTypes, vals)
+	if !ok {
+		t.Fatal("expected columns")
+	}
+
+	block := newBlock(t, chTypes)
+
+	err := writeColumns(block, columns, len(vals))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rowBlock := newBlock(t, chTypes)
+
+	for _, v := range vals {
+		row, err := convertRow(chTypes, v.parsed.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		args := make([]driver.Value, len(row))
+		for i, val := range row {
+			args[i] = val
+		}
+
+		err = rowBlock.AppendRow(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := encodeBlock(t, block)
+	want := encodeBlock(t, rowBlock)
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("got block\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestWriteColumnsMismatch(t *testing.T) {
+	vals := rowValues([]interface{}{json.Number("1")})
+
+	columns, ok := makeColumns(testQuery, []string{"Int8"}, vals)
+	if !ok {
+		t.Fatal("expected columns")
+	}
+
+	// Table was changed after schema was loaded
+	err := writeColumns(newBlock(t, []string{"Int8", "Int8"}), columns, len(vals))
+	if err == nil {
+		t.Error("expected error for other columns count")
+	}
+}
+
+func TestSendFallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		chType  string
+		value   interface{}
+		err     error
+		block   int
+		inserts int
+		mode    string
+	}{
+		{name: "block", chType: "Int32", value: json.Number("1"), block: 1, mode: modeColumnar},
+		{name: "block failed", chType: "Int32", value: json.Number("1"), err: errors.New("block failed"), block: 1, inserts: 1, mode: modeRows},
+		{name: "no typed writer", chType: "Decimal(9, 2)", value: json.Number("1"), inserts: 1, mode: modeRows},
+		{name: "bad value", chType: "Int32", value: "x", inserts: 1, mode: modeRows},
+	}
+
+	for _, tt := range tests {
+		f := &fakeInserter{}
+		w := newTestWriter(f)
+		w.schemas["db.t"] = map[string]string{"a": tt.chType}
+
+		blocks := 0
+
+		w.insertBlock = func(query string, columns []blockColumn, rows int) error {
+			blocks++
+			return tt.err
+		}
+
+		vals := rowValues([]interface{}{tt.value}, []interface{}{tt.value})
+
+		mode := w.send(testQuery, vals)
+
+		if mode != tt.mode || blocks != tt.block || f.calls != tt.inserts {
+			t.Errorf(
+				"%s: got mode %s, %d blocks, %d inserts, want %s, %d, %d",
+				tt.name, mode, blocks, f.calls, tt.mode, tt.block, tt.inserts,
+			)
+		}
+
+		for _, v := range vals {
+			if !v.sent {
+				t.Errorf("%s: value %s is not sent", tt.name, v.id)
+			}
+		}
+	}
+}
@@ -0,0 +1,580 @@
+package writer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var decimalRe = regexp.MustCompile(
+	`^Decimal(?:\(\s*([0-9]+)\s*,\s*([0-9]+)\s*\)|(32|64|128|256)\(\s*([0-9]+)\s*\))`,
+)
+
+var decimalPrecisions = map[string]int{
+	"32":  9,
+	"64":  18,
+	"128": 38,
+	"256": 76,
+}
+
+var tzRe = regexp.MustCompile(`^DateTime(?:64)?(?:\(\s*(?:[0-9]+\s*,?\s*)?(?:'([^']+)'\s*)?\))?$`)
+
+// Loaded time zones of DateTime columns
+var locations = make(map[string]*time.Location)
+var locationsM = &sync.Mutex{}
+
+var dateTimeLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	time.RFC3339Nano,
+	"2006-01-02",
+}
+
+// convertRow converts decoded values to Go types, expected by driver for
+// ClickHouse column types
+func convertRow(chTypes []string, vals []interface{}) ([]interface{}, error) {
+	if len(chTypes) != len(vals) {
+		return nil, fmt.Errorf("expected %d values, got %d", len(chTypes), len(vals))
+	}
+
+	data := make([]interface{}, len(vals))
+
+	for i, v := range vals {
+		conv, err := convert(chTypes[i], v)
+		if err != nil {
+			return nil, fmt.Errorf("column %d: %v", i, err)
+		}
+
+		data[i] = conv
+	}
+
+	return data, nil
+}
+
+// convert converts decoded value to Go type, expected by driver for
+// ClickHouse type
+func convert(chType string, v interface{}) (interface{}, error) {
+	if inner, ok := unwrapType(chType, "LowCardinality"); ok {
+		return convert(inner, v)
+	}
+
+	if inner, ok := unwrapType(chType, "Nullable"); ok {
+		if v == nil {
+			return nil, nil
+		}
+
+		return convert(inner, v)
+	}
+
+	if v == nil {
+		return nil, fmt.Errorf("NULL value for %s", chType)
+	}
+
+	if inner, ok := unwrapType(chType, "Array"); ok {
+		return convertArray(inner, v)
+	}
+
+	switch {
+	case chType == "Int8":
+		n, err := parseInt(v, 8)
+		return int8(n), err
+	case chType == "Int16":
+		n, err := parseInt(v, 16)
+		return int16(n), err
+	case chType == "Int32":
+		n, err := parseInt(v, 32)
+		return int32(n), err
+	case chType == "Int64":
+		return parseInt(v, 64)
+	case chType == "UInt8":
+		n, err := parseUint(v, 8)
+		return uint8(n), err
+	case chType == "UInt16":
+		n, err := parseUint(v, 16)
+		return uint16(n), err
+	case chType == "UInt32":
+		n, err := parseUint(v, 32)
+		return uint32(n), err
+	case chType == "UInt64":
+		return parseUint(v, 64)
+	case chType == "Int128", chType == "Int256", chType == "UInt128", chType == "UInt256":
+		// TODO: write big integers exactly, when ClickHouse driver supports
+		// them. Now such rows are failed instead of silent precision loss.
+		return nil, fmt.Errorf("%s is not supported by ClickHouse driver", chType)
+	case chType == "Float32":
+		f, err := parseFloat(v, 32)
+		return float32(f), err
+	case chType == "Float64":
+		return parseFloat(v, 64)
+	case chType == "String", strings.HasPrefix(chType, "FixedString("):
+		return toString(v)
+	case chType == "UUID":
+		return toString(v)
+	case chType == "Date":
+		return parseDate(v)
+	case strings.HasPrefix(chType, "DateTime"):
+		return parseDateTime(chType, v)
+	case strings.HasPrefix(chType, "Enum"):
+		switch val := v.(type) {
+		case json.Number:
+			return val.Int64()
+		case int64:
+			return val, nil
+		}
+
+		return toString(v)
+	case strings.HasPrefix(chType, "Decimal"):
+		return parseDecimal(chType, v)
+	case chType == "IPv4":
+		return parseIPv4(v)
+	case chType == "IPv6":
+		return parseIPv6(v)
+	}
+
+	return convertNumber(v)
+}
+
+// unwrapType returns inner type of wrapper type, like Nullable(T)
+func unwrapType(chType, wrapper string) (string, bool) {
+	if !strings.HasPrefix(chType, wrapper+"(") || !strings.HasSuffix(chType, ")") {
+		return "", false
+	}
+
+	return chType[len(wrapper)+1 : len(chType)-1], true
+}
+
+func convertArray(inner string, v interface{}) (interface{}, error) {
+	elems, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected array, got %T", v)
+	}
+
+	if len(elems) == 0 {
+		return []string{}, nil
+	}
+
+	convs := make([]interface{}, len(elems))
+
+	// Type of elements is taken from first not empty element, because
+	// empty nested arrays have no type
+	var typ reflect.Type
+
+	for i, elem := range elems {
+		conv, err := convert(inner, elem)
+		if err != nil {
+			return nil, err
+		}
+
+		if conv == nil {
+			return nil, errors.New("NULL values in arrays are not supported")
+		}
+
+		convs[i] = conv
+
+		if typ == nil && !isEmptySlice(conv) {
+			typ = reflect.TypeOf(conv)
+		}
+	}
+
+	if typ == nil {
+		typ = reflect.TypeOf(convs[0])
+	}
+
+	slice := reflect.MakeSlice(reflect.SliceOf(typ), 0, len(convs))
+
+	for _, conv := range convs {
+		val := reflect.ValueOf(conv)
+
+		if val.Type() != typ {
+			if !isEmptySlice(conv) || typ.Kind() != reflect.Slice {
+				return nil, fmt.Errorf("array elements have different types %s and %s", typ, val.Type())
+			}
+
+			val = reflect.MakeSlice(typ, 0, 0)
+		}
+
+		slice = reflect.Append(slice, val)
+	}
+
+	return slice.Interface(), nil
+}
+
+func isEmptySlice(v interface{}) bool {
+	val := reflect.ValueOf(v)
+	return val.Kind() == reflect.Slice && val.Len() == 0
+}
+
+func parseInt(v interface{}, bits int) (int64, error) {
+	switch val := v.(type) {
+	case json.Number:
+		return strconv.ParseInt(string(val), 10, bits)
+	case string:
+		return strconv.ParseInt(val, 10, bits)
+	case int64:
+		return intInRange(val, bits)
+	case uint64:
+		if val > math.MaxInt64 {
+			return 0, fmt.Errorf("integer %d is out of range of %d bits", val, bits)
+		}
+
+		return intInRange(int64(val), bits)
+	case bool:
+		if val {
+			return 1, nil
+		}
+
+		return 0, nil
+	}
+
+	return 0, fmt.Errorf("expected integer, got %T", v)
+}
+
+func parseUint(v interface{}, bits int) (uint64, error) {
+	switch val := v.(type) {
+	case json.Number:
+		return strconv.ParseUint(string(val), 10, bits)
+	case string:
+		return strconv.ParseUint(val, 10, bits)
+	case uint64:
+		return uintInRange(val, bits)
+	case int64:
+		if val < 0 {
+			return 0, fmt.Errorf("integer %d is out of range of unsigned %d bits", val, bits)
+		}
+
+		return uintInRange(uint64(val), bits)
+	case bool:
+		if val {
+			return 1, nil
+		}
+
+		return 0, nil
+	}
+
+	return 0, fmt.Errorf("expected unsigned integer, got %T", v)
+}
+
+func intInRange(n int64, bits int) (int64, error) {
+	if bits < 64 && (n < -1<<uint(bits-1) || n >= 1<<uint(bits-1)) {
+		return 0, fmt.Errorf("integer %d is out of range of %d bits", n, bits)
+	}
+
+	return n, nil
+}
+
+func uintInRange(n uint64, bits int) (uint64, error) {
+	if bits < 64 && n >= 1<<uint(bits) {
+		return 0, fmt.Errorf("integer %d is out of range of unsigned %d bits", n, bits)
+	}
+
+	return n, nil
+}
+
+func parseFloat(v interface{}, bits int) (float64, error) {
+	switch val := v.(type) {
+	case json.Number:
+		return strconv.ParseFloat(string(val), bits)
+	case string:
+		return strconv.ParseFloat(val, bits)
+	case float64:
+		return val, nil
+	case int64:
+		return float64(val), nil
+	case uint64:
+		return float64(val), nil
+	}
+
+	return 0, fmt.Errorf("expected float, got %T", v)
+}
+
+func toString(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case string:
+		return val, nil
+	case json.Number:
+		return string(val), nil
+	case []byte:
+		return string(val), nil
+	case int64:
+		return strconv.FormatInt(val, 10), nil
+	case uint64:
+		return strconv.FormatUint(val, 10), nil
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64), nil
+	}
+
+	return "", fmt.Errorf("expected string, got %T", v)
+}
+
+func parseDate(v interface{}) (time.Time, error) {
+	tm, err := parseTime(v, time.UTC)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Date(tm.Year(), tm.Month(), tm.Day(), 0, 0, 0, 0, time.UTC), nil
+}
+
+func parseDateTime(chType string, v interface{}) (time.Time, error) {
+	loc := time.UTC
+
+	match := tzRe.FindStringSubmatch(chType)
+	if match == nil {
+		return time.Time{}, fmt.Errorf("unknown time type %s", chType)
+	}
+
+	if match[1] != "" {
+		var err error
+
+		loc, err = loadLocation(match[1])
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	return parseTime(v, loc)
+}
+
+// loadLocation returns time zone by name, loading it only once
+func loadLocation(name string) (*time.Location, error) {
+	locationsM.Lock()
+	defer locationsM.Unlock()
+
+	loc, ok := locations[name]
+	if ok {
+		return loc, nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+
+	locations[name] = loc
+
+	return loc, nil
+}
+
+// parseTime parses string in one of known layouts or unix timestamp, may be
+// with fractional seconds. Strings without time zone are parsed in loc.
+func parseTime(v interface{}, loc *time.Location) (time.Time, error) {
+	switch val := v.(type) {
+	case json.Number:
+		return parseUnix(string(val))
+	case int64:
+		return time.Unix(val, 0).UTC(), nil
+	case uint64:
+		if val > math.MaxInt64 {
+			return time.Time{}, fmt.Errorf("timestamp %d is out of range", val)
+		}
+
+		return time.Unix(int64(val), 0).UTC(), nil
+	case time.Time:
+		return val.UTC(), nil
+	case string:
+		for _, layout := range dateTimeLayouts {
+			tm, err := time.ParseInLocation(layout, val, loc)
+			if err == nil {
+				return tm, nil
+			}
+		}
+
+		return time.Time{}, fmt.Errorf("can't parse time %q", val)
+	}
+
+	return time.Time{}, fmt.Errorf("expected time, got %T", v)
+}
+
+// parseUnix parses unix timestamp with up to 9 fractional digits without
+// float rounding
+func parseUnix(str string) (time.Time, error) {
+	secStr, fracStr := str, ""
+
+	dot := strings.IndexByte(str, '.')
+	if dot >= 0 {
+		secStr, fracStr = str[:dot], str[dot+1:]
+	}
+
+	sec, err := strconv.ParseInt(secStr, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("can't parse timestamp %q", str)
+	}
+
+	if len(fracStr) > 9 {
+		return time.Time{}, fmt.Errorf("timestamp %q has more than 9 fractional digits", str)
+	}
+
+	var nsec int64
+
+	if fracStr != "" {
+		nsec, err = strconv.ParseInt(fracStr+strings.Repeat("0", 9-len(fracStr)), 10, 64)
+		if err != nil || nsec < 0 {
+			return time.Time{}, fmt.Errorf("can't parse timestamp %q", str)
+		}
+
+		if strings.HasPrefix(secStr, "-") {
+			nsec = -nsec
+		}
+	}
+
+	return time.Unix(sec, nsec).UTC(), nil
+}
+
+// parseDecimal returns decimal as integer, scaled by scale of column type, as
+// it expected by driver: int64 for Decimal32 and Decimal64 and 16 little-endian
+// bytes for Decimal128. Returns error, if value can't be stored without
+// precision loss.
+func parseDecimal(chType string, v interface{}) (interface{}, error) {
+	str, err := toString(v)
+	if err != nil {
+		return nil, err
+	}
+
+	precision, scale, err := decimalParams(chType)
+	if err != nil {
+		return nil, err
+	}
+
+	rat, ok := new(big.Rat).SetString(str)
+	if !ok {
+		return nil, fmt.Errorf("invalid decimal %q", str)
+	}
+
+	scaled := new(big.Rat).Mul(rat, new(big.Rat).SetInt(pow10(scale)))
+	if !scaled.IsInt() {
+		return nil, fmt.Errorf("decimal %q has more than %d fractional digits", str, scale)
+	}
+
+	num := scaled.Num()
+
+	if new(big.Int).Abs(num).Cmp(pow10(precision)) >= 0 {
+		return nil, fmt.Errorf("decimal %q overflows %s", str, chType)
+	}
+
+	switch {
+	case precision <= 18:
+		return num.Int64(), nil
+	case precision <= 38:
+		return decimal128(num), nil
+	}
+
+	return nil, fmt.Errorf("%s is not supported by ClickHouse driver", chType)
+}
+
+// decimalParams returns precision and scale of Decimal type
+func decimalParams(chType string) (int, int, error) {
+	match := decimalRe.FindStringSubmatch(chType)
+	if match == nil {
+		return 0, 0, fmt.Errorf("unknown decimal type %s", chType)
+	}
+
+	if match[1] != "" {
+		precision, _ := strconv.Atoi(match[1])
+		scale, _ := strconv.Atoi(match[2])
+
+		return precision, scale, nil
+	}
+
+	scale, _ := strconv.Atoi(match[4])
+
+	return decimalPrecisions[match[3]], scale, nil
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// decimal128 returns integer as 16 little-endian bytes in two's complement
+func decimal128(n *big.Int) []byte {
+	u := new(big.Int).Set(n)
+	if u.Sign() < 0 {
+		u.Add(u, new(big.Int).Lsh(big.NewInt(1), 128))
+	}
+
+	be := u.Bytes()
+	le := make([]byte, 16)
+
+	for i, b := range be {
+		le[len(be)-1-i] = b
+	}
+
+	return le
+}
+
+// parseIPv4 parses IPv4 address from string or 4 bytes
+func parseIPv4(v interface{}) (net.IP, error) {
+	if b, ok := v.([]byte); ok && len(b) == net.IPv4len {
+		return net.IP(b), nil
+	}
+
+	str, err := toString(v)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(str).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IPv4 %q", str)
+	}
+
+	return ip, nil
+}
+
+// parseIPv6 parses IPv6 address from string or 16 bytes
+func parseIPv6(v interface{}) (net.IP, error) {
+	if b, ok := v.([]byte); ok && len(b) == net.IPv6len {
+		return net.IP(b), nil
+	}
+
+	str, err := toString(v)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(str)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IPv6 %q", str)
+	}
+
+	return ip.To16(), nil
+}
+
+// convertNumber converts json.Number without loss of precision, if column
+// type is unknown. Integers are converted to int64 or uint64, other numbers to
+// float64. Values, decoded from binary encodings, are already typed.
+func convertNumber(v interface{}) (interface{}, error) {
+	num, ok := v.(json.Number)
+	if !ok {
+		return v, nil
+	}
+
+	if !isInteger(num) {
+		return num.Float64()
+	}
+
+	convI, err := strconv.ParseInt(string(num), 10, 64)
+	if err == nil {
+		return convI, nil
+	}
+
+	convU, err := strconv.ParseUint(string(num), 10, 64)
+	if err == nil {
+		return convU, nil
+	}
+
+	return nil, fmt.Errorf("integer %s can't be converted without precision loss", num)
+}
+
+// isInteger checks, if number is written as integer
+func isInteger(num json.Number) bool {
+	return !strings.ContainsAny(string(num), ".eE")
+}
@@ -0,0 +1,176 @@
+package writer
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConvert(t *testing.T) {
+	tm := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	tests := []struct {
+		chType string
+		in     interface{}
+		out    interface{}
+		err    bool
+	}{
+		{chType: "Int8", in: json.Number("-128"), out: int8(-128)},
+		{chType: "Int8", in: json.Number("128"), err: true},
+		{chType: "Int16", in: int64(1000), out: int16(1000)},
+		{chType: "Int32", in: "42", out: int32(42)},
+		{chType: "Int64", in: json.Number("-9223372036854775808"), out: int64(-9223372036854775808)},
+		{chType: "Int64", in: uint64(9223372036854775808), err: true},
+		{chType: "Int64", in: json.Number("1.5"), err: true},
+		{chType: "UInt8", in: true, out: uint8(1)},
+		{chType: "UInt8", in: int64(256), err: true},
+		{chType: "UInt16", in: int64(-1), err: true},
+		{chType: "UInt32", in: json.Number("4294967295"), out: uint32(4294967295)},
+		{chType: "UInt64", in: json.Number("18446744073709551615"), out: uint64(18446744073709551615)},
+		{chType: "Float32", in: json.Number("1.5"), out: float32(1.5)},
+		{chType: "Float64", in: int64(3), out: float64(3)},
+		{chType: "Float64", in: "x", err: true},
+		{chType: "String", in: json.Number("12"), out: "12"},
+		{chType: "String", in: []byte("abc"), out: "abc"},
+		{chType: "FixedString(3)", in: "abc", out: "abc"},
+		{chType: "String", in: map[string]interface{}{}, err: true},
+		{chType: "UUID", in: "8d6b2b7e-7a2c-4b3a-9d2e-0c5e1f2a3b4c", out: "8d6b2b7e-7a2c-4b3a-9d2e-0c5e1f2a3b4c"},
+		{chType: "Date", in: "2019-03-04", out: time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC)},
+		{chType: "Date", in: tm, out: time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC)},
+		{chType: "DateTime", in: "2019-03-04 05:06:07", out: tm},
+		{chType: "DateTime", in: "2019-03-04T05:06:07", out: tm},
+		{chType: "DateTime", in: "2019-03-04T08:06:07+03:00", out: tm},
+		{chType: "DateTime", in: json.Number("1551675967"), out: tm},
+		{chType: "DateTime", in: int64(1551675967), out: tm},
+		{chType: "DateTime", in: "yesterday", err: true},
+		{chType: "DateTime('Europe/Moscow')", in: "2019-03-04 08:06:07", out: tm},
+		{chType: "DateTime('Europe/Moscow')", in: "2019-03-04T05:06:07Z", out: tm},
+		{chType: "DateTime('Nowhere/Never')", in: "2019-03-04 05:06:07", err: true},
+		{chType: "DateTime64(3)", in: json.Number("1551675967.25"), out: tm.Add(250 * time.Millisecond)},
+		{chType: "DateTime64(3, 'Europe/Moscow')", in: "2019-03-04 08:06:07.25", out: tm.Add(250 * time.Millisecond)},
+		{chType: "DateTime64(9)", in: json.Number("1551675967.1234567891"), err: true},
+		{chType: "LowCardinality(String)", in: json.Number("12"), out: "12"},
+		{chType: "LowCardinality(Nullable(String))", in: nil, out: nil},
+		{chType: "Enum8('a' = 1, 'b' = 2)", in: "a", out: "a"},
+		{chType: "Enum8('a' = 1, 'b' = 2)", in: json.Number("2"), out: int64(2)},
+		{chType: "Nullable(Int8)", in: nil, out: nil},
+		{chType: "Nullable(Int8)", in: json.Number("1"), out: int8(1)},
+		{chType: "Int8", in: nil, err: true},
+		{chType: "Array(UInt8)", in: []interface{}{json.Number("1"), json.Number("2")}, out: []uint8{1, 2}},
+		{chType: "Array(String)", in: []interface{}{}, out: []string{}},
+		{chType: "Array(Array(String))", in: []interface{}{[]interface{}{"a"}}, out: [][]string{{"a"}}},
+		{chType: "Array(Array(UInt8))", in: []interface{}{[]interface{}{}, []interface{}{json.Number("1")}}, out: [][]uint8{{}, {1}}},
+		{chType: "Array(Array(UInt8))", in: []interface{}{[]interface{}{}}, out: [][]string{{}}},
+		{chType: "Array(Nullable(Int8))", in: []interface{}{nil}, err: true},
+		{chType: "Array(Int8)", in: "1", err: true},
+		{chType: "Decimal(9, 2)", in: json.Number("1.25"), out: int64(125)},
+		{chType: "Decimal32(2)", in: "-1.5", out: int64(-150)},
+		{chType: "Decimal(18, 0)", in: json.Number("999999999999999999"), out: int64(999999999999999999)},
+		{chType: "Decimal(9, 2)", in: json.Number("1.255"), err: true},
+		{chType: "Decimal(3, 1)", in: json.Number("100"), err: true},
+		{chType: "Decimal(9, 2)", in: "abc", err: true},
+		{chType: "Decimal(38, 2)", in: "-0.01", out: bytes.Repeat([]byte{0xff}, 16)},
+		{chType: "Decimal128(0)", in: json.Number("18446744073709551616"), out: []byte{0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0}},
+		{chType: "Decimal(9, 2)", in: float64(0.1), out: int64(10)},
+		{chType: "Decimal(76, 2)", in: json.Number("1.25"), err: true},
+		{chType: "Decimal256(2)", in: json.Number("1.25"), err: true},
+		{chType: "Int128", in: json.Number("1"), err: true},
+		{chType: "UInt256", in: json.Number("115792089237316195423570985008687907853269984665640564039457584007913129639935"), err: true},
+		{chType: "IPv4", in: "10.0.0.1", out: net.IP{10, 0, 0, 1}},
+		{chType: "IPv4", in: []byte{10, 0, 0, 1}, out: net.IP{10, 0, 0, 1}},
+		{chType: "IPv4", in: "::1", err: true},
+		{chType: "IPv6", in: "::1", out: net.ParseIP("::1")},
+		{chType: "IPv6", in: "10.0.0.1", out: net.ParseIP("10.0.0.1")},
+		{chType: "IPv6", in: "localhost", err: true},
+	}
+
+	for _, tt := range tests {
+		out, err := convert(tt.chType, tt.in)
+
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s %#v: expected error, got %#v", tt.chType, tt.in, out)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s %#v: %v", tt.chType, tt.in, err)
+			continue
+		}
+
+		// Times with zone offset are the same instant
+		if want, ok := tt.out.(time.Time); ok {
+			if got, ok := out.(time.Time); !ok || !got.Equal(want) {
+				t.Errorf("%s %#v: got %#v, want %v", tt.chType, tt.in, out, want)
+			}
+
+			continue
+		}
+
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("%s %#v: got %#v, want %#v", tt.chType, tt.in, out, tt.out)
+		}
+	}
+}
+
+func TestConvertRow(t *testing.T) {
+	row, err := convertRow([]string{"UInt8", "String"}, []interface{}{json.Number("1"), "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(row, []interface{}{uint8(1), "a"}) {
+		t.Errorf("got %#v", row)
+	}
+
+	_, err = convertRow([]string{"UInt8"}, []interface{}{json.Number("1"), "a"})
+	if err == nil {
+		t.Error("expected error for wrong number of values")
+	}
+
+	_, err = convertRow([]string{"UInt8", "UInt8"}, []interface{}{json.Number("1"), "a"})
+	if err == nil {
+		t.Error("expected error for wrong value")
+	}
+}
+
+func TestConvertNumber(t *testing.T) {
+	tests := []struct {
+		in  interface{}
+		out interface{}
+		err bool
+	}{
+		{in: json.Number("-1"), out: int64(-1)},
+		{in: json.Number("18446744073709551615"), out: uint64(18446744073709551615)},
+		{in: json.Number("1e3"), out: float64(1000)},
+		{in: json.Number("0.5"), out: float64(0.5)},
+		{in: json.Number("18446744073709551616"), err: true},
+		{in: "abc", out: "abc"},
+	}
+
+	for _, tt := range tests {
+		out, err := convertNumber(tt.in)
+
+		if tt.err {
+			if err == nil {
+				t.Errorf("%#v: expected error, got %#v", tt.in, out)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%#v: %v", tt.in, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("%#v: got %#v, want %#v", tt.in, out, tt.out)
+		}
+	}
+}
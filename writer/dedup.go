@@ -0,0 +1,135 @@
+package writer
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"git.aqq.me/go/lrucache"
+	"git.aqq.me/go/nanachi"
+)
+
+// Same split, as driver uses to cut VALUES from insert query
+var valuesRe = regexp.MustCompile(`(?i)\sVALUES\s*\(`)
+
+type dedupConfig struct {
+	// Pass insert_deduplication_token setting with every insert
+	Token bool
+	// Maximum number of recently committed message IDs
+	CacheSize int
+	// Time to keep committed message ID in seconds
+	CacheTTL int
+}
+
+func newCommitted(cnf dedupConfig) *lrucache.Cache {
+	if cnf.CacheSize <= 0 {
+		return nil
+	}
+
+	return lrucache.New(
+		lrucache.Config{
+			MaxEntries: cnf.CacheSize,
+			TTL:        time.Duration(cnf.CacheTTL) * time.Second,
+		},
+	)
+}
+
+// messageID returns AMQP MessageId or, if it is empty, hash of message body
+func messageID(msg *nanachi.Delivery) string {
+	if msg.MessageId != "" {
+		return msg.MessageId
+	}
+
+	sum := sha1.Sum(msg.Body)
+
+	return "sha1:" + hex.EncodeToString(sum[:])
+}
+
+// isCommitted checks, if redelivered message was already inserted
+func (w *Writer) isCommitted(msg *nanachi.Delivery, id string) bool {
+	if w.committed == nil || !msg.Redelivered {
+		return false
+	}
+
+	return w.committed.Exists(id)
+}
+
+// setCommitted remembers ID of message with all rows inserted
+func (w *Writer) setCommitted(id string) {
+	if w.committed == nil {
+		return
+	}
+
+	w.committed.Set(id, true)
+}
+
+// byMessage splits values to groups of the same message, keeping order of
+// messages and rows
+func byMessage(vals []*toSend) [][]*toSend {
+	var groups [][]*toSend
+
+	idx := make(map[*delivery]int)
+
+	for _, v := range vals {
+		i, ok := idx[v.delivery]
+		if !ok {
+			i = len(groups)
+			idx[v.delivery] = i
+			groups = append(groups, nil)
+		}
+
+		groups[i] = append(groups[i], v)
+	}
+
+	return groups
+}
+
+// rowID returns ID of row of message. Multi-row message rows are identified
+// by message ID and row number.
+func rowID(id string, row, rows int) string {
+	if rows == 1 {
+		return id
+	}
+
+	return id + "#" + strconv.Itoa(row)
+}
+
+// dedupQuery adds insert_deduplication_token setting to insert query. Token is
+// built from IDs of inserted values regardless of their order, so retry of
+// the same values and insert of the same rows of redelivered message get the
+// same token.
+func (w *Writer) dedupQuery(query string, vals []*toSend) string {
+	if !w.config.Deduplication.Token {
+		return query
+	}
+
+	loc := valuesRe.FindStringIndex(query)
+	if loc == nil {
+		return query
+	}
+
+	ids := make([]string, 0, len(vals))
+
+	for _, v := range vals {
+		if !v.failed && !v.sent {
+			ids = append(ids, v.id)
+		}
+	}
+
+	sort.Strings(ids)
+
+	h := sha256.New()
+
+	for _, id := range ids {
+		h.Write([]byte(id))
+		h.Write([]byte{0})
+	}
+
+	token := hex.EncodeToString(h.Sum(nil))
+
+	return query[:loc[0]] + " SETTINGS insert_deduplication_token = '" + token + "'" + query[loc[0]:]
+}
@@ -0,0 +1,190 @@
+package writer
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"git.aqq.me/go/nanachi"
+	"github.com/streadway/amqp"
+)
+
+func TestMessageID(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  amqp.Delivery
+		id   string
+	}{
+		{
+			name: "message id",
+			msg:  amqp.Delivery{MessageId: "abc", Body: []byte("body")},
+			id:   "abc",
+		},
+		{
+			name: "body hash",
+			msg:  amqp.Delivery{Body: []byte("body")},
+			id:   "sha1:02083f4579e08a612425c0c1a17ee47add783b94",
+		},
+	}
+
+	for _, tt := range tests {
+		id := messageID(&nanachi.Delivery{Delivery: tt.msg})
+		if id != tt.id {
+			t.Errorf("%s: got %q, want %q", tt.name, id, tt.id)
+		}
+	}
+}
+
+func TestRowID(t *testing.T) {
+	tests := []struct {
+		row, rows int
+		id        string
+	}{
+		{0, 1, "abc"},
+		{0, 2, "abc#0"},
+		{1, 2, "abc#1"},
+	}
+
+	for _, tt := range tests {
+		id := rowID("abc", tt.row, tt.rows)
+		if id != tt.id {
+			t.Errorf("row %d of %d: got %q, want %q", tt.row, tt.rows, id, tt.id)
+		}
+	}
+}
+
+func TestDedupQuery(t *testing.T) {
+	w := &Writer{config: writerConfig{Deduplication: dedupConfig{Token: true}}}
+
+	query := "INSERT INTO db.t (a) VALUES (?)"
+
+	a := &toSend{id: "a"}
+	b := &toSend{id: "b"}
+
+	tests := []struct {
+		name  string
+		query string
+		vals  []*toSend
+		same  []*toSend
+		other []*toSend
+	}{
+		{
+			name:  "order",
+			vals:  []*toSend{a, b},
+			same:  []*toSend{b, a},
+			other: []*toSend{a},
+		},
+		{
+			name:  "failed and sent values",
+			vals:  []*toSend{a},
+			same:  []*toSend{a, {id: "c", failed: true}, {id: "d", sent: true}},
+			other: []*toSend{b},
+		},
+	}
+
+	for _, tt := range tests {
+		deduped := w.dedupQuery(query, tt.vals)
+
+		if !strings.HasPrefix(deduped, "INSERT INTO db.t (a) SETTINGS insert_deduplication_token = '") ||
+			!strings.HasSuffix(deduped, "' VALUES (?)") {
+			t.Errorf("%s: invalid query %q", tt.name, deduped)
+		}
+
+		if w.dedupQuery(query, tt.same) != deduped {
+			t.Errorf("%s: token differs for the same values", tt.name)
+		}
+
+		if w.dedupQuery(query, tt.other) == deduped {
+			t.Errorf("%s: token is the same for other values", tt.name)
+		}
+	}
+
+	// Queries without VALUES and disabled token are not changed
+	if q := w.dedupQuery("INSERT INTO db.t SELECT 1", []*toSend{a}); q != "INSERT INTO db.t SELECT 1" {
+		t.Errorf("query without values is changed: %q", q)
+	}
+
+	w.config.Deduplication.Token = false
+
+	if q := w.dedupQuery(query, []*toSend{a}); q != query {
+		t.Errorf("query is changed with disabled token: %q", q)
+	}
+}
+
+func TestByMessage(t *testing.T) {
+	a := &delivery{id: "a"}
+	b := &delivery{id: "b"}
+
+	vals := []*toSend{
+		{id: "a#0", delivery: a},
+		{id: "b", delivery: b},
+		{id: "a#1", delivery: a},
+	}
+
+	groups := byMessage(vals)
+
+	if len(groups) != 2 || len(groups[0]) != 2 || len(groups[1]) != 1 {
+		t.Fatalf("got %d groups", len(groups))
+	}
+
+	if groups[0][0].id != "a#0" || groups[0][1].id != "a#1" || groups[1][0].id != "b" {
+		t.Errorf("got %v", groups)
+	}
+}
+
+// Redelivered message gets the same token, however it is batched
+func TestSendTokenPerMessage(t *testing.T) {
+	f := &fakeInserter{}
+	w := newTestWriter(f)
+	w.config.Deduplication.Token = true
+	w.schemas["db.t"] = map[string]string{"a": "Int32"}
+
+	inserts := make(map[string][]int)
+
+	w.insertBlock = func(query string, columns []blockColumn, rows int) error {
+		inserts[query] = append(inserts[query], rows)
+		return nil
+	}
+
+	newMessage := func(id string, rows int) []*toSend {
+		d := &delivery{id: id}
+		vals := make([]*toSend, rows)
+
+		for i := range vals {
+			vals[i] = rowValues([]interface{}{json.Number(strconv.Itoa(i))})[0]
+			vals[i].id = rowID(id, i, rows)
+			vals[i].delivery = d
+		}
+
+		return vals
+	}
+
+	w.send(testQuery, append(newMessage("a", 2), newMessage("b", 1)...))
+
+	// After crash "a" is redelivered and batched with other message
+	w.send(testQuery, append(newMessage("c", 3), newMessage("a", 2)...))
+
+	if len(inserts) != 3 {
+		t.Fatalf("got %d tokens for 3 messages", len(inserts))
+	}
+
+	tests := []struct {
+		id   string
+		rows int
+		want []int
+	}{
+		{id: "a", rows: 2, want: []int{2, 2}},
+		{id: "b", rows: 1, want: []int{1}},
+		{id: "c", rows: 3, want: []int{3}},
+	}
+
+	for _, tt := range tests {
+		got := inserts[w.dedupQuery(testQuery, newMessage(tt.id, tt.rows))]
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("message %s: got inserts of %v rows with its token, want %v", tt.id, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package writer
+
+import (
+	"sort"
+	"sync"
+
+	"git.aqq.me/go/nanachi"
+	"github.com/kak-tus/corrie/message"
+)
+
+// delivery tracks rows of one message. Rows are sent in one batch, but can be
+// inserted in different transactions, message is acked only when all its rows
+// are resolved: inserted, failed or parked.
+type delivery struct {
+	msg     *nanachi.Delivery
+	id      string
+	rows    int
+	pending int
+	failed  []*toSend
+	parked  []*toSend
+	m       *sync.Mutex
+}
+
+func newDelivery(msg *nanachi.Delivery, id string, rows int) *delivery {
+	return &delivery{
+		msg:     msg,
+		id:      id,
+		rows:    rows,
+		pending: rows,
+		m:       &sync.Mutex{},
+	}
+}
+
+// resolve marks row as resolved. Returns true for the last row.
+func (d *delivery) resolve(v *toSend) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if v.failed {
+		d.failed = append(d.failed, v)
+	}
+
+	if v.parked {
+		d.parked = append(d.parked, v)
+	}
+
+	d.pending--
+
+	return d.pending == 0
+}
+
+// finish acks message with all rows inserted. Message with failed rows is
+// moved to failed queue and message with parked rows is moved to parking queue
+// of table. If only some rows of multi-row message are not inserted, new
+// message with these rows only is moved.
+func (w *Writer) finish(d *delivery) {
+	if len(d.failed) == 0 && len(d.parked) == 0 {
+		w.setCommitted(d.id)
+		w.ack(d.msg)
+		return
+	}
+
+	// Failed rows are parked too, if table is not writable
+	if len(d.parked) > 0 {
+		vals := append(d.parked, d.failed...)
+		table := tableLabel(vals[0].parsed.Query)
+
+		body, err := w.remainder(d, vals)
+		if err != nil {
+			w.logger.Error("Encode failed: ", err)
+			w.reader.ToFailedQueue(d.msg, vals[0].failure)
+			return
+		}
+
+		parked.Inc(w.name, table)
+		w.reader.ToParkingQueue(d.msg, body, d.msg.ContentEncoding, table, vals[0].failure)
+
+		return
+	}
+
+	failure := d.failed[0].failure
+
+	if len(d.failed) == d.rows {
+		w.reader.ToFailedQueue(d.msg, failure)
+		return
+	}
+
+	body, err := w.remainder(d, d.failed)
+	if err != nil {
+		w.logger.Error("Encode failed: ", err)
+		w.reader.ToFailedQueue(d.msg, failure)
+		return
+	}
+
+	w.logger.Infof("Move %d of %d rows of message %q to failed queue", len(d.failed), d.rows, d.id)
+	w.reader.ToFailedQueueWithBody(d.msg, body, d.msg.ContentEncoding, failure)
+}
+
+// remainder returns body of message with not inserted rows only. Original
+// body is returned, if no rows are inserted.
+func (w *Writer) remainder(d *delivery, vals []*toSend) ([]byte, error) {
+	if len(vals) == d.rows {
+		return d.msg.Body, nil
+	}
+
+	sort.Slice(vals, func(i, j int) bool {
+		return vals[i].row < vals[j].row
+	})
+
+	rows := make([][]interface{}, len(vals))
+	for i, v := range vals {
+		rows[i] = v.parsed.Data
+	}
+
+	body, err := message.Message{Query: vals[0].parsed.Query, Rows: rows}.EncodeContent(d.msg.ContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compressed as original message
+	return message.Compress(d.msg.ContentEncoding, body)
+}
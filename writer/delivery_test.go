@@ -0,0 +1,149 @@
+package writer
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"git.aqq.me/go/nanachi"
+	"github.com/kak-tus/corrie/message"
+	"github.com/streadway/amqp"
+	"go.uber.org/zap"
+)
+
+// fakeAcknowledger counts acks and nacks of delivery
+type fakeAcknowledger struct {
+	acks  int
+	nacks int
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acks++
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacks++
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.nacks++
+	return nil
+}
+
+func TestFinishAfterLastRow(t *testing.T) {
+	ack := &fakeAcknowledger{}
+	msg := &nanachi.Delivery{Delivery: amqp.Delivery{Acknowledger: ack}}
+	w := &Writer{name: "test", logger: zap.NewNop().Sugar()}
+
+	d := newDelivery(msg, "id", 3)
+
+	// Rows are resolved by different batches in any order
+	for i, row := range []int{2, 0, 1} {
+		last := d.resolve(&toSend{row: row, sent: true})
+
+		if last != (i == 2) {
+			t.Fatalf("row %d: got last %v", row, last)
+		}
+
+		if last {
+			w.finish(d)
+		}
+
+		if want := map[bool]int{false: 0, true: 1}[last]; ack.acks != want {
+			t.Fatalf("row %d: got %d acks, want %d", row, ack.acks, want)
+		}
+	}
+}
+
+func TestResolveCollectsNotInserted(t *testing.T) {
+	d := newDelivery(&nanachi.Delivery{}, "id", 3)
+
+	failed := &toSend{row: 0, failed: true}
+	parked := &toSend{row: 1, parked: true}
+
+	d.resolve(failed)
+	d.resolve(parked)
+
+	if !d.resolve(&toSend{row: 2, sent: true}) {
+		t.Fatal("last row is not reported")
+	}
+
+	if !reflect.DeepEqual(d.failed, []*toSend{failed}) || !reflect.DeepEqual(d.parked, []*toSend{parked}) {
+		t.Errorf("got failed %v and parked %v", d.failed, d.parked)
+	}
+}
+
+func TestRemainder(t *testing.T) {
+	query := "INSERT INTO db.t (a) VALUES (?)"
+
+	tests := []struct {
+		contentType string
+		encoding    string
+	}{
+		{"", ""},
+		{message.ContentTypeJSON, message.EncodingGzip},
+		{message.ContentTypeMsgpack, message.EncodingZstd},
+		{message.ContentTypeProto, message.EncodingLZ4},
+	}
+
+	for _, tt := range tests {
+		vals := make([]*toSend, 4)
+		rows := make([][]interface{}, 4)
+
+		for i := range vals {
+			rows[i] = []interface{}{"row" + strconv.Itoa(i)}
+			vals[i] = &toSend{row: i, parsed: message.Message{Query: query, Data: rows[i]}}
+		}
+
+		body, err := message.Message{Query: query, Rows: rows}.EncodeContent(tt.contentType)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body, err = message.Compress(tt.encoding, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg := &nanachi.Delivery{Delivery: amqp.Delivery{
+			ContentType:     tt.contentType,
+			ContentEncoding: tt.encoding,
+			Body:            body,
+		}}
+
+		d := newDelivery(msg, "id", len(rows))
+		w := &Writer{}
+
+		// Failed rows come in order of batches
+		remainder, err := w.remainder(d, []*toSend{vals[3], vals[1]})
+		if err != nil {
+			t.Errorf("%q %q: %v", tt.contentType, tt.encoding, err)
+			continue
+		}
+
+		decompressed, err := message.Decompress(tt.encoding, remainder, message.DefaultMaxSize)
+		if err != nil {
+			t.Errorf("%q %q: remainder is not compressed as original: %v", tt.contentType, tt.encoding, err)
+			continue
+		}
+
+		parsed, err := message.DecodeContent(tt.contentType, decompressed)
+		if err != nil {
+			t.Errorf("%q %q: %v", tt.contentType, tt.encoding, err)
+			continue
+		}
+
+		want := message.Message{Query: query, Rows: [][]interface{}{rows[1], rows[3]}}
+		if !reflect.DeepEqual(parsed, want) {
+			t.Errorf("%q %q: got %+v, want %+v", tt.contentType, tt.encoding, parsed, want)
+		}
+
+		// Original body is kept, if all rows failed
+		remainder, err = w.remainder(d, vals)
+		if err != nil || !reflect.DeepEqual(remainder, body) {
+			t.Errorf("%q %q: original body is not kept: %v", tt.contentType, tt.encoding, err)
+		}
+	}
+}
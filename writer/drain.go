@@ -0,0 +1,59 @@
+package writer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Default deadline of graceful shutdown in seconds
+const defaultDrainTimeout = 30
+
+// drain stops consuming, flushes all batches, waits for failed queue publish
+// confirms and acks. Values, not finished at deadline, are left unacked to be
+// redelivered by RabbitMQ.
+func (w *Writer) drain() {
+	if atomic.LoadInt32(&w.started) == 0 {
+		w.reader.Stop()
+		return
+	}
+
+	deadline := time.Now().Add(time.Duration(w.config.DrainTimeout) * time.Second)
+	handledBefore := atomic.LoadInt64(&w.handled)
+
+	w.reader.Stop()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-w.done:
+	case <-timer.C:
+		w.logger.Errorf("Drain deadline %dsec reached", w.config.DrainTimeout)
+		close(w.abandon)
+
+		// Consuming stops on abandon, nothing is sent to failed queue after it
+		<-w.done
+	}
+
+	// Producer is closed even after deadline, publishes of workers, still
+	// sending, are refused and their messages are left unacked
+	err := w.reader.CloseProducer(time.Until(deadline))
+	if err != nil {
+		w.logger.Error("Drain failed: ", err)
+	}
+
+	w.logger.Infof(
+		"Drained %d values, abandoned %d values",
+		atomic.LoadInt64(&w.handled)-handledBefore, w.state.pending(),
+	)
+}
+
+// abandoned checks, if deadline of shutdown is reached
+func (w *Writer) abandoned() bool {
+	select {
+	case <-w.abandon:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,115 @@
+package writer
+
+import (
+	"database/sql/driver"
+	"io"
+	"net"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/kak-tus/corrie/reader"
+)
+
+// Error classes
+const (
+	classRow           = "row"
+	classNetwork       = "network"
+	classTimeout       = "timeout"
+	classTooManyParts  = "tooManyParts"
+	classSyntax        = "syntax"
+	classUnknownTable  = "unknownTable"
+	classUnknownColumn = "unknownColumn"
+	classTypeMismatch  = "typeMismatch"
+	classOther         = "other"
+)
+
+// ClickHouse exception codes to error classes
+var codeClasses = map[int32]string{
+	3:   classNetwork,       // UNEXPECTED_END_OF_FILE
+	6:   classRow,           // CANNOT_PARSE_TEXT
+	8:   classUnknownColumn, // THERE_IS_NO_COLUMN
+	16:  classUnknownColumn, // NO_SUCH_COLUMN_IN_TABLE
+	25:  classRow,           // CANNOT_PARSE_ESCAPE_SEQUENCE
+	26:  classRow,           // CANNOT_PARSE_QUOTED_STRING
+	27:  classRow,           // CANNOT_PARSE_INPUT_ASSERTION_FAILED
+	38:  classRow,           // CANNOT_PARSE_DATE
+	41:  classRow,           // CANNOT_PARSE_DATETIME
+	43:  classTypeMismatch,  // ILLEGAL_TYPE_OF_ARGUMENT
+	47:  classUnknownColumn, // UNKNOWN_IDENTIFIER
+	53:  classTypeMismatch,  // TYPE_MISMATCH
+	60:  classUnknownTable,  // UNKNOWN_TABLE
+	62:  classSyntax,        // SYNTAX_ERROR
+	69:  classRow,           // ARGUMENT_OUT_OF_BOUND
+	70:  classTypeMismatch,  // CANNOT_CONVERT_TYPE
+	72:  classRow,           // CANNOT_PARSE_NUMBER
+	81:  classUnknownTable,  // UNKNOWN_DATABASE
+	117: classRow,           // INCORRECT_DATA
+	131: classRow,           // TOO_LARGE_STRING_SIZE
+	159: classTimeout,       // TIMEOUT_EXCEEDED
+	209: classTimeout,       // SOCKET_TIMEOUT
+	210: classNetwork,       // NETWORK_ERROR
+	252: classTooManyParts,  // TOO_MANY_PARTS
+	279: classNetwork,       // ALL_CONNECTION_TRIES_FAILED
+	321: classRow,           // VALUE_IS_OUT_OF_RANGE_OF_DATA_TYPE
+	349: classRow,           // CANNOT_INSERT_NULL_IN_ORDINARY_COLUMN
+	407: classRow,           // DECIMAL_OVERFLOW
+}
+
+func (e *stageError) Error() string {
+	return e.err.Error()
+}
+
+func (v *toSend) fail(err error) {
+	v.failed = true
+	v.class = classify(err)
+	v.failure = reader.Failure{
+		Stage: reader.StageCommit,
+		Error: err.Error(),
+	}
+
+	se, ok := err.(*stageError)
+	if ok {
+		v.failure.Stage = se.stage
+		err = se.err
+	}
+
+	exception, ok := err.(*clickhouse.Exception)
+	if ok {
+		v.failure.Code = exception.Code
+		v.failure.Error = exception.Message
+	}
+}
+
+// classify returns error class
+func classify(err error) string {
+	se, ok := err.(*stageError)
+	if ok {
+		err = se.err
+	}
+
+	switch e := err.(type) {
+	case *clickhouse.Exception:
+		class, ok := codeClasses[e.Code]
+		if ok {
+			return class
+		}
+
+		return classOther
+	case net.Error:
+		if e.Timeout() {
+			return classTimeout
+		}
+
+		return classNetwork
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == driver.ErrBadConn {
+		return classNetwork
+	}
+
+	return classOther
+}
+
+// isRowError checks, if error looks like caused by some rows of batch
+func isRowError(err error) bool {
+	return classify(err) == classRow
+}
@@ -0,0 +1,58 @@
+package writer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/kak-tus/corrie/reader"
+)
+
+func TestIsRowError(t *testing.T) {
+	tests := []struct {
+		err error
+		row bool
+	}{
+		{&clickhouse.Exception{Code: 27}, true},
+		{&clickhouse.Exception{Code: 349}, true},
+		{&stageError{stage: reader.StageCommit, err: &clickhouse.Exception{Code: 41}}, true},
+		{&clickhouse.Exception{Code: 62}, false},
+		{&clickhouse.Exception{Code: 210}, false},
+		{errors.New("unknown"), false},
+	}
+
+	for _, tt := range tests {
+		if isRowError(tt.err) != tt.row {
+			t.Errorf("%#v: want row error %v", tt.err, tt.row)
+		}
+	}
+}
+
+func TestFail(t *testing.T) {
+	tests := []struct {
+		err     error
+		failure reader.Failure
+	}{
+		{
+			err:     errors.New("broken"),
+			failure: reader.Failure{Stage: reader.StageCommit, Error: "broken"},
+		},
+		{
+			err:     &clickhouse.Exception{Code: 27, Message: "cannot parse"},
+			failure: reader.Failure{Stage: reader.StageCommit, Code: 27, Error: "cannot parse"},
+		},
+		{
+			err:     &stageError{stage: reader.StageExec, err: &clickhouse.Exception{Code: 53, Message: "type mismatch"}},
+			failure: reader.Failure{Stage: reader.StageExec, Code: 53, Error: "type mismatch"},
+		},
+	}
+
+	for _, tt := range tests {
+		v := &toSend{}
+		v.fail(tt.err)
+
+		if !v.failed || v.failure != tt.failure {
+			t.Errorf("%#v: got %+v, want %+v", tt.err, v.failure, tt.failure)
+		}
+	}
+}
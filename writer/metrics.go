@@ -0,0 +1,71 @@
+package writer
+
+import "github.com/kak-tus/corrie/metrics"
+
+var (
+	consumed = metrics.NewCounter(
+		"corrie_messages_consumed_total", "Messages, received from RabbitMQ", "pipeline",
+	)
+	decoded = metrics.NewCounter(
+		"corrie_messages_decoded_total", "Successfully decoded messages", "pipeline",
+	)
+	failed = metrics.NewCounter(
+		"corrie_messages_failed_total", "Failed messages by processing stage", "pipeline", "stage",
+	)
+	acked = metrics.NewCounter(
+		"corrie_messages_acked_total", "Acked messages", "pipeline",
+	)
+	duplicates = metrics.NewCounter(
+		"corrie_messages_duplicate_total", "Redelivered messages, dropped because they are already inserted", "pipeline",
+	)
+	rowsInserted = metrics.NewCounter(
+		"corrie_rows_inserted_total", "Rows, inserted to Clickhouse", "pipeline", "table",
+	)
+	retries = metrics.NewCounter(
+		"corrie_retry_attempts_total", "Retries of failed inserts by error class", "pipeline", "class",
+	)
+	batchSize = metrics.NewHistogram(
+		"corrie_batch_size", "Number of values in flushed batch",
+		[]float64{1, 10, 100, 1000, 10000, 100000}, "pipeline",
+	)
+	insertLatency = metrics.NewHistogram(
+		"corrie_insert_duration_seconds", "Time to insert batch to Clickhouse",
+		metrics.DefBuckets, "pipeline", "mode",
+	)
+	ackLatency = metrics.NewHistogram(
+		"corrie_ack_duration_seconds", "Time to ack batch messages",
+		metrics.DefBuckets, "pipeline",
+	)
+	lag = metrics.NewHistogram(
+		"corrie_lag_seconds", "Time from message timestamp to insert",
+		[]float64{.1, .5, 1, 5, 10, 30, 60, 300, 900, 3600}, "pipeline",
+	)
+	bufferedQueries = metrics.NewGauge(
+		"corrie_buffered_queries", "Number of queries with pending batches", "pipeline",
+	)
+	bufferedValues = metrics.NewGauge(
+		"corrie_buffered_values", "Number of values in pending batches", "pipeline",
+	)
+	parked = metrics.NewCounter(
+		"corrie_messages_parked_total", "Messages, moved to parking queue of table with stopped inserts", "pipeline", "table",
+	)
+	breakerOpen = metrics.NewGauge(
+		"corrie_breaker_open", "Inserts to table are stopped by circuit breaker", "pipeline", "table",
+	)
+	bufferedBytes = metrics.NewGauge(
+		"corrie_buffered_bytes", "Size of values in pending batches", "pipeline",
+	)
+)
+
+// Label of not parsed queries
+const unknownTable = "unknown"
+
+// tableLabel returns table of insert query to label metrics
+func tableLabel(query string) string {
+	parsed, err := parseInsert(query)
+	if err != nil {
+		return unknownTable
+	}
+
+	return parsed.Database + "." + parsed.Table
+}
@@ -0,0 +1,116 @@
+package writer
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"git.aqq.me/go/nanachi"
+)
+
+// Backslash in quoted identifier is escape for ClickHouse and is not allowed
+const ident = "(?:[A-Za-z_][A-Za-z0-9_]*|`[^`\\\\]+`|\"[^\"\\\\]+\")"
+
+var insertRe = regexp.MustCompile(
+	`(?is)^\s*INSERT\s+INTO\s+(?:(` + ident + `)\s*\.\s*)?(` + ident + `)\s*` +
+		`\(\s*(` + ident + `(?:\s*,\s*` + ident + `)*)\s*\)\s*` +
+		`VALUES\s*(?:\(\s*(?:\?(?:\s*,\s*\?)*)?\s*\)\s*)?;?\s*$`,
+)
+
+var columnSepRe = regexp.MustCompile(`\s*,\s*`)
+
+type policyConfig struct {
+	Tables []tablePolicy
+}
+
+type tablePolicy struct {
+	Database string
+	// "*" - any table of database
+	Table string
+	// Allowed AMQP UserId values. Empty - any user.
+	Users []string
+	// Allowed AMQP AppId values. Empty - any application.
+	Apps []string
+}
+
+// insertQuery holds parsed INSERT query
+type insertQuery struct {
+	Database string
+	Table    string
+	Columns  []string
+}
+
+// parseInsert parses "INSERT INTO db.table (cols) VALUES" query
+func parseInsert(query string) (insertQuery, error) {
+	match := insertRe.FindStringSubmatch(query)
+	if match == nil {
+		return insertQuery{}, errors.New("only INSERT INTO <db>.<table> (<columns>) VALUES queries are allowed")
+	}
+
+	parsed := insertQuery{
+		Database: unquoteIdent(match[1]),
+		Table:    unquoteIdent(match[2]),
+	}
+
+	for _, col := range columnSepRe.Split(match[3], -1) {
+		parsed.Columns = append(parsed.Columns, unquoteIdent(col))
+	}
+
+	return parsed, nil
+}
+
+func unquoteIdent(name string) string {
+	if len(name) >= 2 && (name[0] == '`' || name[0] == '"') {
+		return name[1 : len(name)-1]
+	}
+
+	return name
+}
+
+// checkPolicy checks, if message is allowed to be written by allow-list
+// policy. Any message is allowed, if policy is not configured.
+func (w *Writer) checkPolicy(query string, msg *nanachi.Delivery) error {
+	if len(w.config.Policy.Tables) == 0 {
+		return nil
+	}
+
+	parsed, err := parseInsert(query)
+	if err != nil {
+		return err
+	}
+
+	if parsed.Database == "" {
+		return errors.New("table must be qualified with database")
+	}
+
+	for _, p := range w.config.Policy.Tables {
+		if p.Database != parsed.Database ||
+			(p.Table != "*" && p.Table != parsed.Table) {
+			continue
+		}
+
+		if len(p.Users) > 0 && !contains(p.Users, msg.UserId) {
+			return fmt.Errorf("user %q is not allowed to write to %s.%s", msg.UserId, parsed.Database, parsed.Table)
+		}
+
+		if len(p.Apps) > 0 && !contains(p.Apps, msg.AppId) {
+			return fmt.Errorf("application %q is not allowed to write to %s.%s", msg.AppId, parsed.Database, parsed.Table)
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("table %s.%s is not allowed", parsed.Database, parsed.Table)
+}
+
+// contains checks, if list has value. AMQP UserId and AppId are compared case
+// sensitive.
+func contains(list []string, val string) bool {
+	for _, v := range list {
+		if v == val {
+			return true
+		}
+	}
+
+	return false
+}
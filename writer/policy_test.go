@@ -0,0 +1,123 @@
+package writer
+
+import (
+	"reflect"
+	"testing"
+
+	"git.aqq.me/go/nanachi"
+	"github.com/streadway/amqp"
+)
+
+func TestParseInsert(t *testing.T) {
+	tests := []struct {
+		query  string
+		parsed insertQuery
+		err    bool
+	}{
+		{
+			query:  "INSERT INTO db.t (a, b) VALUES (?, ?)",
+			parsed: insertQuery{Database: "db", Table: "t", Columns: []string{"a", "b"}},
+		},
+		{
+			query:  "insert into `my db`.\"my table\"(`a b`) values",
+			parsed: insertQuery{Database: "my db", Table: "my table", Columns: []string{"a b"}},
+		},
+		{
+			query:  "INSERT INTO t (a) VALUES (?);",
+			parsed: insertQuery{Table: "t", Columns: []string{"a"}},
+		},
+		{
+			query: "INSERT INTO db.t SELECT * FROM db.secret",
+			err:   true,
+		},
+		{
+			query: "INSERT INTO db.t (a) VALUES (?); DROP TABLE db.t",
+			err:   true,
+		},
+		{
+			query: "INSERT INTO default.test (`a\\`, `b) SELECT * FROM secret.users --`) VALUES (?, ?)",
+			err:   true,
+		},
+		{
+			query: "INSERT INTO default.\"t\\\" (a)\" VALUES (?)",
+			err:   true,
+		},
+		{
+			query: "ALTER TABLE db.t DELETE WHERE 1",
+			err:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		parsed, err := parseInsert(tt.query)
+
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected error", tt.query)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(parsed, tt.parsed) {
+			t.Errorf("%q: got %+v, want %+v", tt.query, parsed, tt.parsed)
+		}
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	w := &Writer{
+		config: writerConfig{
+			Policy: policyConfig{
+				Tables: []tablePolicy{
+					{Database: "db", Table: "events", Users: []string{"producer"}, Apps: []string{"billing"}},
+					{Database: "logs", Table: "*"},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		user  string
+		app   string
+		err   bool
+	}{
+		{"allowed", "INSERT INTO db.events (a) VALUES (?)", "producer", "billing", false},
+		{"any table of database", "INSERT INTO logs.access (a) VALUES (?)", "", "", false},
+		{"other table", "INSERT INTO db.users (a) VALUES (?)", "producer", "billing", true},
+		{"not qualified table", "INSERT INTO events (a) VALUES (?)", "producer", "billing", true},
+		{"other user", "INSERT INTO db.events (a) VALUES (?)", "guest", "billing", true},
+		{"other app", "INSERT INTO db.events (a) VALUES (?)", "producer", "reports", true},
+		{"user case", "INSERT INTO db.events (a) VALUES (?)", "Producer", "billing", true},
+		{"app case", "INSERT INTO db.events (a) VALUES (?)", "producer", "BILLING", true},
+		{"not insert", "SELECT 1", "producer", "billing", true},
+	}
+
+	for _, tt := range tests {
+		msg := &nanachi.Delivery{Delivery: amqp.Delivery{UserId: tt.user, AppId: tt.app}}
+
+		err := w.checkPolicy(tt.query, msg)
+		if tt.err && err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+
+		if !tt.err && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+
+	// Any query is allowed without policy
+	w.config.Policy.Tables = nil
+
+	err := w.checkPolicy("SELECT 1", &nanachi.Delivery{})
+	if err != nil {
+		t.Errorf("without policy: %v", err)
+	}
+}
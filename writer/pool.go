@@ -0,0 +1,237 @@
+package writer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// job is a batch of values, handed over to flush workers
+type job struct {
+	query string
+	table string
+	// Key of concurrency limit
+	key  string
+	vals []*toSend
+}
+
+// pool holds batches, waiting for flush workers. Worker takes the oldest batch
+// of table, which has free slots, so batches of busy table don't hold workers
+// from other tables.
+type pool struct {
+	// Concurrent inserts per table
+	limit   int
+	jobs    []*job
+	running map[string]int
+	closed  bool
+	m       *sync.Mutex
+	cond    *sync.Cond
+}
+
+func newPool(limit int) *pool {
+	m := &sync.Mutex{}
+
+	return &pool{
+		limit:   limit,
+		running: make(map[string]int),
+		m:       m,
+		cond:    sync.NewCond(m),
+	}
+}
+
+func (p *pool) push(j *job) {
+	p.m.Lock()
+	p.jobs = append(p.jobs, j)
+	p.m.Unlock()
+
+	p.cond.Broadcast()
+}
+
+// next waits for batch of table with free slots and takes slot. Returns nil,
+// if pool is closed and all batches are taken.
+func (p *pool) next() *job {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	for {
+		for i, j := range p.jobs {
+			if p.running[j.key] >= p.limit {
+				continue
+			}
+
+			p.jobs = append(p.jobs[:i], p.jobs[i+1:]...)
+			p.running[j.key]++
+
+			return j
+		}
+
+		if p.closed && len(p.jobs) == 0 {
+			return nil
+		}
+
+		p.cond.Wait()
+	}
+}
+
+// done releases slot of batch table
+func (p *pool) done(j *job) {
+	p.m.Lock()
+
+	p.running[j.key]--
+	if p.running[j.key] == 0 {
+		delete(p.running, j.key)
+	}
+
+	p.m.Unlock()
+
+	p.cond.Broadcast()
+}
+
+func (p *pool) close() {
+	p.m.Lock()
+	p.closed = true
+	p.m.Unlock()
+
+	p.cond.Broadcast()
+}
+
+func (w *Writer) startWorkers() {
+	for i := 0; i < w.config.Workers; i++ {
+		w.wg.Add(1)
+
+		go func() {
+			defer w.wg.Done()
+
+			for {
+				j := w.pool.next()
+				if j == nil {
+					return
+				}
+
+				w.process(j)
+				w.pool.done(j)
+			}
+		}()
+	}
+}
+
+// stopWorkers waits, while all batches in flight are processed
+func (w *Writer) stopWorkers() {
+	w.pool.close()
+	w.wg.Wait()
+}
+
+// enqueue hands batch over to flush workers. Blocks, if too many batches are
+// in flight.
+func (w *Writer) enqueue(query, table string, vals []*toSend) {
+	select {
+	case w.inFlight <- struct{}{}:
+	case <-w.abandon:
+		w.logger.Errorf("Leave %d values unacked on shutdown for %q", len(vals), query)
+		return
+	}
+
+	w.pool.push(&job{query: query, table: table, key: tableKey(query), vals: vals})
+}
+
+// process sends batch and acks its messages. Batch of table with stopped
+// inserts is parked.
+func (w *Writer) process(j *job) {
+	if w.abandoned() {
+		w.logger.Errorf("Leave %d values unacked on shutdown for %q", len(j.vals), j.query)
+		<-w.inFlight
+		return
+	}
+
+	started := time.Now()
+
+	var mode string
+
+	if w.breaker.isOpen(j.table) {
+		park(j.table, j.vals)
+		mode = modeParked
+	} else {
+		mode = w.send(j.query, j.vals)
+
+		if w.breaker.update(j.table, j.query, j.vals) {
+			w.logger.Errorf(
+				"Stop inserts to table %s after %d consecutive failures, park its messages to %s",
+				j.table, w.config.Breaker.Threshold, w.reader.ParkingQueue(j.table),
+			)
+
+			breakerOpen.Set(1, w.name, j.table)
+			park(j.table, j.vals)
+		}
+	}
+
+	diffSend := time.Now().Sub(started)
+	started = time.Now()
+
+	w.observe(j, mode, diffSend)
+
+	// Deadline of shutdown is reached, messages are redelivered by RabbitMQ
+	if w.abandoned() {
+		w.logger.Errorf("Leave %d values unacked on shutdown for %q", len(j.vals), j.query)
+		<-w.inFlight
+		return
+	}
+
+	for _, v := range j.vals {
+		if v.delivery.resolve(v) {
+			w.finish(v.delivery)
+		}
+	}
+
+	atomic.AddInt64(&w.handled, int64(len(j.vals)))
+
+	diffAck := time.Now().Sub(started)
+	ackLatency.Observe(diffAck.Seconds(), w.name)
+	w.state.processed(j.table, j.vals)
+
+	w.logger.Infof(
+		"Sent %d values in %fsec (%.0f values/sec, %s), acked in %fsec for %q",
+		len(j.vals), diffSend.Seconds(), float64(len(j.vals))/diffSend.Seconds(),
+		mode, diffAck.Seconds(), j.query,
+	)
+
+	<-w.inFlight
+}
+
+// observe updates metrics of sent batch
+func (w *Writer) observe(j *job, mode string, diffSend time.Duration) {
+	batchSize.Observe(float64(len(j.vals)), w.name)
+	insertLatency.Observe(diffSend.Seconds(), w.name, mode)
+
+	now := time.Now()
+	inserted := 0
+
+	for _, v := range j.vals {
+		if v.failed {
+			failed.Inc(w.name, v.failure.Stage)
+			continue
+		}
+
+		if v.parked {
+			continue
+		}
+
+		inserted++
+
+		ts := v.delivery.msg.Timestamp
+		if !ts.IsZero() {
+			lag.Observe(now.Sub(ts).Seconds(), w.name)
+		}
+	}
+
+	rowsInserted.Add(float64(inserted), w.name, j.table)
+}
+
+// tableKey returns table of query, concurrent inserts to which are limited
+func tableKey(query string) string {
+	parsed, err := parseInsert(query)
+	if err != nil {
+		return query
+	}
+
+	return parsed.Database + "." + parsed.Table
+}
@@ -0,0 +1,85 @@
+package writer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPoolSkipsBusyTable(t *testing.T) {
+	p := newPool(1)
+
+	a1 := &job{key: "db.a"}
+	a2 := &job{key: "db.a"}
+	b := &job{key: "db.b"}
+
+	p.push(a1)
+	p.push(a2)
+	p.push(b)
+
+	if j := p.next(); j != a1 {
+		t.Fatalf("got %v, want first batch of db.a", j)
+	}
+
+	// db.a has no free slots, its second batch waits
+	if j := p.next(); j != b {
+		t.Fatalf("got %v, want batch of db.b", j)
+	}
+
+	taken := make(chan *job)
+
+	go func() {
+		taken <- p.next()
+	}()
+
+	select {
+	case j := <-taken:
+		t.Fatalf("got %v while db.a is busy", j)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.done(a1)
+
+	select {
+	case j := <-taken:
+		if j != a2 {
+			t.Fatalf("got %v, want second batch of db.a", j)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("batch is not taken after slot is released")
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	p := newPool(2)
+
+	j := &job{key: "db.a"}
+	p.push(j)
+	p.close()
+
+	// Batches, pushed before close, are still taken
+	if got := p.next(); got != j {
+		t.Fatalf("got %v, want pushed batch", got)
+	}
+
+	if got := p.next(); got != nil {
+		t.Fatalf("got %v from closed pool", got)
+	}
+}
+
+func TestTableKey(t *testing.T) {
+	tests := []struct {
+		query string
+		key   string
+	}{
+		{"INSERT INTO db.t (a) VALUES (?)", "db.t"},
+		{"INSERT INTO db.t(a, b) VALUES (?, ?)", "db.t"},
+		{"SELECT 1", "SELECT 1"},
+	}
+
+	for _, tt := range tests {
+		key := tableKey(tt.query)
+		if key != tt.key {
+			t.Errorf("%q: got %q, want %q", tt.query, key, tt.key)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package writer
+
+import "time"
+
+type retryPolicy struct {
+	// 0 - retry infinitely, 1 - fail at once
+	MaxAttempts int
+	// Initial interval in seconds, doubled for every next attempt
+	Interval int
+	// Maximum interval in seconds
+	MaxInterval int
+}
+
+var defaultRetryPolicy = retryPolicy{
+	MaxAttempts: 0,
+	Interval:    5,
+	MaxInterval: 5,
+}
+
+func (w *Writer) policy(class string) retryPolicy {
+	p, ok := w.config.Retry[class]
+	if ok {
+		return p
+	}
+
+	p, ok = w.config.Retry[classOther]
+	if ok {
+		return p
+	}
+
+	return defaultRetryPolicy
+}
+
+func (p retryPolicy) exhausted(attempts int) bool {
+	return p.MaxAttempts > 0 && attempts >= p.MaxAttempts
+}
+
+func (p retryPolicy) delay(attempts int) time.Duration {
+	delay := time.Duration(p.Interval) * time.Second
+	max := time.Duration(p.MaxInterval) * time.Second
+
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+
+	if max > 0 && delay > max {
+		delay = max
+	}
+
+	return delay
+}
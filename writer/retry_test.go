@@ -0,0 +1,108 @@
+package writer
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/kak-tus/corrie/reader"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		policy   retryPolicy
+		attempts int
+		delay    time.Duration
+	}{
+		{retryPolicy{Interval: 1, MaxInterval: 10}, 1, time.Second},
+		{retryPolicy{Interval: 1, MaxInterval: 10}, 2, 2 * time.Second},
+		{retryPolicy{Interval: 1, MaxInterval: 10}, 4, 8 * time.Second},
+		{retryPolicy{Interval: 1, MaxInterval: 10}, 5, 10 * time.Second},
+		{retryPolicy{Interval: 1, MaxInterval: 10}, 100, 10 * time.Second},
+		{retryPolicy{Interval: 5, MaxInterval: 5}, 3, 5 * time.Second},
+		{retryPolicy{Interval: 0, MaxInterval: 10}, 3, 0},
+	}
+
+	for _, tt := range tests {
+		delay := tt.policy.delay(tt.attempts)
+		if delay != tt.delay {
+			t.Errorf("%+v, attempt %d: got %v, want %v", tt.policy, tt.attempts, delay, tt.delay)
+		}
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	tests := []struct {
+		max       int
+		attempts  int
+		exhausted bool
+	}{
+		{0, 1000, false},
+		{1, 1, true},
+		{3, 2, false},
+		{3, 3, true},
+	}
+
+	for _, tt := range tests {
+		p := retryPolicy{MaxAttempts: tt.max}
+
+		if p.exhausted(tt.attempts) != tt.exhausted {
+			t.Errorf("max %d, attempt %d: want exhausted %v", tt.max, tt.attempts, tt.exhausted)
+		}
+	}
+}
+
+func TestRetryPolicyFallback(t *testing.T) {
+	row := retryPolicy{MaxAttempts: 1}
+	other := retryPolicy{MaxAttempts: 3, Interval: 1, MaxInterval: 2}
+
+	w := &Writer{config: writerConfig{Retry: map[string]retryPolicy{classRow: row}}}
+
+	if p := w.policy(classNetwork); p != defaultRetryPolicy {
+		t.Errorf("got %+v, want default policy", p)
+	}
+
+	w.config.Retry[classOther] = other
+
+	if p := w.policy(classRow); p != row {
+		t.Errorf("got %+v, want policy of class", p)
+	}
+
+	if p := w.policy(classNetwork); p != other {
+		t.Errorf("got %+v, want policy of other errors", p)
+	}
+}
+
+type timeoutError struct {
+	timeout bool
+}
+
+func (e timeoutError) Error() string   { return "i/o error" }
+func (e timeoutError) Timeout() bool   { return e.timeout }
+func (e timeoutError) Temporary() bool { return false }
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err   error
+		class string
+	}{
+		{&clickhouse.Exception{Code: 6}, classRow},
+		{&clickhouse.Exception{Code: 60}, classUnknownTable},
+		{&clickhouse.Exception{Code: 252}, classTooManyParts},
+		{&clickhouse.Exception{Code: 1}, classOther},
+		{&stageError{stage: reader.StageExec, err: &clickhouse.Exception{Code: 53}}, classTypeMismatch},
+		{timeoutError{timeout: true}, classTimeout},
+		{timeoutError{}, classNetwork},
+		{io.EOF, classNetwork},
+		{errors.New("unknown"), classOther},
+	}
+
+	for _, tt := range tests {
+		class := classify(tt.err)
+		if class != tt.class {
+			t.Errorf("%#v: got %q, want %q", tt.err, class, tt.class)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package writer
+
+import "fmt"
+
+const schemaQuery = `
+SELECT name, type
+FROM system.columns
+WHERE database = %s AND table = ?
+`
+
+// columnTypes returns ClickHouse types of INSERT query columns. Types are
+// loaded from system.columns and cached per table. Returns nil, if types are
+// unknown.
+func (w *Writer) columnTypes(query string) []string {
+	parsed, err := parseInsert(query)
+	if err != nil {
+		return nil
+	}
+
+	key := parsed.Database + "." + parsed.Table
+
+	w.schemasM.Lock()
+	schema, ok := w.schemas[key]
+	w.schemasM.Unlock()
+
+	if !ok {
+		schema, err = w.loadSchema(parsed.Database, parsed.Table)
+		if err != nil {
+			w.logger.Error("Load schema failed: ", err)
+			return nil
+		}
+
+		w.schemasM.Lock()
+		w.schemas[key] = schema
+		w.schemasM.Unlock()
+	}
+
+	chTypes := make([]string, len(parsed.Columns))
+
+	for i, col := range parsed.Columns {
+		chType, ok := schema[col]
+		if !ok {
+			return nil
+		}
+
+		chTypes[i] = chType
+	}
+
+	return chTypes
+}
+
+// resetSchema drops cached types of INSERT query table
+func (w *Writer) resetSchema(query string) {
+	parsed, err := parseInsert(query)
+	if err != nil {
+		return
+	}
+
+	w.schemasM.Lock()
+	delete(w.schemas, parsed.Database+"."+parsed.Table)
+	w.schemasM.Unlock()
+}
+
+func (w *Writer) loadSchema(database, table string) (map[string]string, error) {
+	dbExpr := "currentDatabase()"
+	args := []interface{}{table}
+
+	if database != "" {
+		dbExpr = "?"
+		args = []interface{}{database, table}
+	}
+
+	rows, err := w.db.Query(fmt.Sprintf(schemaQuery, dbExpr), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	schema := make(map[string]string)
+
+	for rows.Next() {
+		var name, chType string
+
+		err := rows.Scan(&name, &chType)
+		if err != nil {
+			return nil, err
+		}
+
+		schema[name] = chType
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(schema) == 0 {
+		return nil, fmt.Errorf("table %s.%s not found", database, table)
+	}
+
+	return schema, nil
+}
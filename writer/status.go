@@ -0,0 +1,144 @@
+package writer
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Default timeout of Clickhouse ping in seconds
+const defaultPingTimeout = 2
+
+// Status holds Clickhouse health details and inserts state
+type Status struct {
+	Accessible  bool                   `json:"accessible"`
+	Error       string                 `json:"error,omitempty"`
+	Pending     int                    `json:"pending"`
+	Tables      map[string]TableStatus `json:"tables"`
+	LastError   string                 `json:"last_error,omitempty"`
+	LastErrorAt *time.Time             `json:"last_error_at,omitempty"`
+}
+
+// TableStatus holds inserts state of table
+type TableStatus struct {
+	// Values, buffered or in flight
+	Pending     int        `json:"pending"`
+	LastFlush   *time.Time `json:"last_flush,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	// Inserts are stopped by circuit breaker since
+	ParkedSince *time.Time `json:"parked_since,omitempty"`
+}
+
+type writerState struct {
+	m      sync.Mutex
+	tables map[string]*TableStatus
+	// Last failed value of any table
+	lastError   string
+	lastErrorAt time.Time
+}
+
+func (s *writerState) table(name string) *TableStatus {
+	t, ok := s.tables[name]
+	if !ok {
+		t = &TableStatus{}
+		s.tables[name] = t
+	}
+
+	return t
+}
+
+func (s *writerState) added(table string) {
+	s.m.Lock()
+	s.table(table).Pending++
+	s.m.Unlock()
+}
+
+// pending returns number of values, buffered or in flight, of all tables
+func (s *writerState) pending() int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	total := 0
+	for _, t := range s.tables {
+		total += t.Pending
+	}
+
+	return total
+}
+
+// processed updates table state after batch is sent and acked
+func (s *writerState) processed(table string, vals []*toSend) {
+	now := time.Now()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	t := s.table(table)
+	t.Pending -= len(vals)
+
+	for _, v := range vals {
+		if v.failed {
+			at := now
+			t.LastError = v.failure.Error
+			t.LastErrorAt = &at
+			s.lastError = v.failure.Error
+			s.lastErrorAt = now
+		} else if v.sent {
+			at := now
+			t.LastFlush = &at
+		}
+	}
+}
+
+// Status pings Clickhouse and returns it with inserts state
+func (w *Writer) Status() Status {
+	err := w.ping()
+
+	w.state.m.Lock()
+	defer w.state.m.Unlock()
+
+	st := Status{
+		Accessible: err == nil,
+		Tables:     make(map[string]TableStatus, len(w.state.tables)),
+		LastError:  w.state.lastError,
+	}
+
+	if err != nil {
+		st.Error = err.Error()
+	}
+
+	if !w.state.lastErrorAt.IsZero() {
+		at := w.state.lastErrorAt
+		st.LastErrorAt = &at
+	}
+
+	for name, t := range w.state.tables {
+		st.Tables[name] = *t
+		st.Pending += t.Pending
+	}
+
+	for name, since := range w.breaker.openedSince() {
+		t := st.Tables[name]
+		t.ParkedSince = &since
+		st.Tables[name] = t
+	}
+
+	return st
+}
+
+// ping pings Clickhouse with timeout
+func (w *Writer) ping() error {
+	res := make(chan error, 1)
+
+	go func() {
+		res <- w.Ping()
+	}()
+
+	select {
+	case err := <-res:
+		return err
+	case <-time.After(time.Duration(w.config.PingTimeout) * time.Second):
+		return errors.New("ping timeout")
+	}
+}
@@ -1,12 +1,13 @@
 package writer
 
 import (
+	"container/list"
 	"database/sql"
 	"sync"
 
+	"git.aqq.me/go/lrucache"
 	"git.aqq.me/go/nanachi"
-	"git.aqq.me/go/retrier"
-	jsoniter "github.com/json-iterator/go"
+	"github.com/ClickHouse/clickhouse-go"
 	"github.com/kak-tus/corrie/message"
 	"github.com/kak-tus/corrie/reader"
 	"go.uber.org/zap"
@@ -14,26 +15,95 @@ import (
 
 // Writer hold object
 type Writer struct {
-	logger     *zap.SugaredLogger
-	config     writerConfig
-	db         *sql.DB
-	c          <-chan *nanachi.Delivery
-	decoder    jsoniter.API
-	m          *sync.Mutex
-	reader     *reader.Reader
-	toSendVals map[string][]*toSend
-	toSendCnts map[string]int
-	retrier    *retrier.Retrier
+	name      string
+	logger    *zap.SugaredLogger
+	config    writerConfig
+	db        *sql.DB
+	conns     chan clickhouse.Clickhouse
+	c         <-chan *nanachi.Delivery
+	m         *sync.Mutex
+	reader    *reader.Reader
+	batches   map[string]*batch
+	lru       *list.List
+	bytes     int
+	values    int
+	limits    LimitStats
+	schemas   map[string]map[string]string
+	schemasM  *sync.Mutex
+	pool      *pool
+	inFlight  chan struct{}
+	wg        *sync.WaitGroup
+	state     *writerState
+	started   int32
+	done      chan struct{}
+	abandon   chan struct{}
+	committed *lrucache.Cache
+	breaker   *breaker
+	// Inserts values in one transaction, replaced in tests
+	insert func(query string, chTypes []string, vals []*toSend) error
+	// Writes columns as one native block, replaced in tests
+	insertBlock func(query string, columns []blockColumn, rows int) error
+	// Values, acked or handed over to failed queue
+	handled int64
 }
 
+const (
+	modeColumnar = "columnar"
+	modeRows     = "rows"
+	modeParked   = "parked"
+)
+
 type writerConfig struct {
 	ClickhouseURI string
 	Batch         int
 	Period        int
+	Retry         map[string]retryPolicy
+	Policy        policyConfig
+	Workers       int
+	TableWorkers  int
+	MaxInFlight   int
+	MaxQueries    int
+	MaxBatchBytes int
+	MaxBytes      int
+	// Maximum size of decompressed message body in bytes
+	MaxBodySize int
+	Tables      map[string]tableConfig
+	// Timeout of health ping in seconds
+	PingTimeout int
+	// Deadline of graceful shutdown in seconds
+	DrainTimeout  int
+	Deduplication dedupConfig
+	Breaker       breakerConfig
+}
+
+// tableConfig overrides batch settings per table
+type tableConfig struct {
+	Batch int
+	// Maximum age of oldest batch value in seconds
+	MaxAge int
 }
 
+// toSend holds one row of message
 type toSend struct {
-	parsed  message.Message
-	nanachi *nanachi.Delivery
+	// Row ID, built from MessageId or body hash
+	id       string
+	parsed   message.Message
+	delivery *delivery
+	// Row number in message
+	row int
+	// Approximate size of row in message body
+	size    int
 	failed  bool
+	failure reader.Failure
+	// Class of failure error
+	class string
+	sent  bool
+	// Table inserts are stopped, row is moved to parking queue
+	parked bool
+}
+
+// stageError holds error with processing stage, where it occurred
+type stageError struct {
+	stage string
+	err   error
 }
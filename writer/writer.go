@@ -1,97 +1,163 @@
 package writer
 
 import (
+	"container/list"
 	"database/sql"
-	"encoding/json"
 	"fmt"
+	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"git.aqq.me/go/nanachi"
 
-	"git.aqq.me/go/app/appconf"
 	"git.aqq.me/go/app/applog"
-	"git.aqq.me/go/app/event"
-	"git.aqq.me/go/retrier"
+	"github.com/ClickHouse/clickhouse-go"
 	"github.com/iph0/conf"
-	jsoniter "github.com/json-iterator/go"
 	"github.com/kak-tus/corrie/message"
 	"github.com/kak-tus/corrie/reader"
-	"github.com/kshvakov/clickhouse"
 )
 
-var wrt *Writer
+// Driver can't read and write LowCardinality columns in native format
+const lowCardinalitySetting = "low_cardinality_allow_in_native_format"
 
-func init() {
-	event.Init.AddHandler(
-		func() error {
-			cnfMap := appconf.GetConfig()["writer"]
+// New creates writer of pipeline, reading messages from reader
+func New(name string, rdr *reader.Reader, cnfMap interface{}) (*Writer, error) {
+	var cnf writerConfig
 
-			var cnf writerConfig
-			err := conf.Decode(cnfMap, &cnf)
-			if err != nil {
-				return err
-			}
+	err := conf.Decode(cnfMap, &cnf)
+	if err != nil {
+		return nil, err
+	}
 
-			db, err := sql.Open("clickhouse", cnf.ClickhouseURI)
-			if err != nil {
-				return err
-			}
+	cnf.ClickhouseURI, err = clickhouseURI(cnf.ClickhouseURI)
+	if err != nil {
+		return nil, err
+	}
 
-			err = db.Ping()
-			if err != nil {
-				exception, ok := err.(*clickhouse.Exception)
-				if ok {
-					return fmt.Errorf("[%d] %s \n%s", exception.Code, exception.Message, exception.StackTrace)
-				}
+	db, err := sql.Open("clickhouse", cnf.ClickhouseURI)
+	if err != nil {
+		return nil, err
+	}
 
-				return err
-			}
+	if cnf.Workers < 1 {
+		cnf.Workers = 1
+	}
 
-			wrt = &Writer{
-				logger:     applog.GetLogger().Sugar(),
-				config:     cnf,
-				db:         db,
-				decoder:    jsoniter.Config{UseNumber: true}.Froze(),
-				m:          &sync.Mutex{},
-				reader:     reader.GetReader(),
-				toSendCnts: make(map[string]int),
-				toSendVals: make(map[string][]*toSend),
-				retrier:    retrier.New(retrier.Config{RetryPolicy: []time.Duration{time.Second * 5}}),
-			}
+	if cnf.TableWorkers < 1 || cnf.TableWorkers > cnf.Workers {
+		cnf.TableWorkers = cnf.Workers
+	}
 
-			wrt.logger.Info("Started writer")
+	if cnf.MaxInFlight < cnf.Workers {
+		cnf.MaxInFlight = cnf.Workers
+	}
+
+	if cnf.PingTimeout <= 0 {
+		cnf.PingTimeout = defaultPingTimeout
+	}
+
+	if cnf.DrainTimeout <= 0 {
+		cnf.DrainTimeout = defaultDrainTimeout
+	}
 
-			return nil
-		},
-	)
+	if cnf.MaxBodySize <= 0 {
+		cnf.MaxBodySize = message.DefaultMaxSize
+	}
 
-	event.Stop.AddHandler(
-		func() error {
-			wrt.logger.Info("Stop writer")
+	if cnf.Breaker.ProbeInterval <= 0 {
+		cnf.Breaker.ProbeInterval = defaultProbeInterval
+	}
 
-			wrt.reader.Stop()
+	w := &Writer{
+		name:      name,
+		logger:    applog.GetLogger().Sugar().With("pipeline", name),
+		config:    cnf,
+		db:        db,
+		m:         &sync.Mutex{},
+		reader:    rdr,
+		batches:   make(map[string]*batch),
+		lru:       list.New(),
+		schemas:   make(map[string]map[string]string),
+		schemasM:  &sync.Mutex{},
+		conns:     make(chan clickhouse.Clickhouse, cnf.Workers),
+		pool:      newPool(cnf.TableWorkers),
+		inFlight:  make(chan struct{}, cnf.MaxInFlight),
+		wg:        &sync.WaitGroup{},
+		state:     &writerState{tables: make(map[string]*TableStatus)},
+		done:      make(chan struct{}),
+		abandon:   make(chan struct{}),
+		committed: newCommitted(cnf.Deduplication),
+		breaker:   newBreaker(cnf.Breaker),
+	}
 
-			wrt.m.Lock()
-			wrt.db.Close()
+	w.insert = w.insertRows
+	w.insertBlock = w.sendColumnar
 
-			return nil
-		},
-	)
+	w.logger.Info("Started writer")
+
+	return w, nil
 }
 
-// GetWriter return instance
-func GetWriter() *Writer {
-	return wrt
+// clickhouseURI disables LowCardinality in native format, if it is not set in
+// URI, so ClickHouse converts LowCardinality columns from and to their inner
+// types, supported by driver
+func clickhouseURI(uri string) (string, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+
+	query := parsed.Query()
+
+	if query.Get(lowCardinalitySetting) == "" {
+		query.Set(lowCardinalitySetting, "false")
+	}
+
+	parsed.RawQuery = query.Encode()
+
+	return parsed.String(), nil
+}
+
+// Close drains writer and closes Clickhouse connections
+func (w *Writer) Close() {
+	w.logger.Info("Stop writer")
+
+	w.drain()
+	w.stopProbe()
+
+	w.closeConns()
+	w.db.Close()
+
+	if w.committed != nil {
+		w.committed.Clean()
+	}
+}
+
+// Ping checks Clickhouse connection
+func (w *Writer) Ping() error {
+	err := w.db.Ping()
+	if err != nil {
+		exception, ok := err.(*clickhouse.Exception)
+		if ok {
+			return fmt.Errorf("[%d] %s \n%s", exception.Code, exception.Message, exception.StackTrace)
+		}
+
+		return err
+	}
+
+	return nil
 }
 
 // Start writer
-func (w Writer) Start() {
+func (w *Writer) Start() {
 	w.m.Lock()
+	atomic.StoreInt32(&w.started, 1)
 
 	w.reader.Start()
-	sendPeriod := time.Duration(w.config.Period) * time.Second
-	tick := time.NewTicker(sendPeriod)
+	w.startWorkers()
+	w.startProbe()
+
+	tick := time.NewTicker(expireCheckPeriod)
 
 	for {
 		var msg *nanachi.Delivery
@@ -100,178 +166,361 @@ func (w Writer) Start() {
 		case msg, more = <-w.reader.C:
 			break
 		case <-tick.C:
-			w.logger.Debug("Sent periodically")
-			w.sendAll()
+			w.sendExpired()
 			continue
+		case <-w.abandon:
+			break
+		}
+		// Deadline of shutdown is reached, workers are not waited and
+		// buffered messages are redelivered by RabbitMQ
+		if w.abandoned() {
+			tick.Stop()
+			w.pool.close()
+			close(w.done)
+			break
 		}
 		if !more {
 			w.sendAll()
 			tick.Stop()
+			w.stopWorkers()
+			close(w.done)
 			break
 		}
 
-		var parsed message.Message
-		err := w.decoder.Unmarshal(msg.Body, &parsed)
-		if err != nil {
-			w.logger.Error("Decode failed: ", err)
-			w.reader.ToFailedQueue(msg)
+		consumed.Inc(w.name)
 
-			err := msg.Ack(false)
-			if err != nil {
-				w.logger.Error("Ack failed: ", err)
-			}
+		id := messageID(msg)
+
+		if w.isCommitted(msg, id) {
+			w.logger.Infof("Drop redelivered message %q, it is already inserted", id)
+			duplicates.Inc(w.name)
+			w.ack(msg)
 
 			continue
 		}
 
-		if w.toSendVals[parsed.Query] == nil {
-			w.toSendVals[parsed.Query] = make([]*toSend, w.config.Batch)
-			w.toSendCnts[parsed.Query] = 0
+		parsed, err := w.decode(msg)
+		if err == nil {
+			parsed, err = parsed.ToV1()
 		}
 
-		w.toSendVals[parsed.Query][w.toSendCnts[parsed.Query]] = &toSend{
-			parsed:  parsed,
-			nanachi: msg,
-			failed:  false,
+		if err != nil {
+			w.logger.Error("Decode failed: ", err)
+			w.reader.ToFailedQueue(msg, reader.Failure{Stage: reader.StageDecode, Error: err.Error()})
+			failed.Inc(w.name, reader.StageDecode)
+
+			continue
 		}
 
-		w.toSendCnts[parsed.Query]++
+		decoded.Inc(w.name)
+
+		err = w.checkPolicy(parsed.Query, msg)
+		if err != nil {
+			w.logger.Error("Policy violation: ", err)
+			w.reader.ToFailedQueue(msg, reader.Failure{Stage: reader.StagePolicy, Error: "policy violation: " + err.Error()})
+			failed.Inc(w.name, reader.StagePolicy)
 
-		if w.toSendCnts[parsed.Query] >= w.config.Batch {
-			w.sendOne(parsed.Query)
+			continue
 		}
+
+		w.expand(msg, id, parsed)
 	}
 
 	w.m.Unlock()
 }
 
-// IsAccessible checks Clickhouse status
-func (w Writer) IsAccessible() bool {
-	for i := 0; i < 10; i++ {
-		err := w.db.Ping()
-		if err == nil {
-			return true
+// ack acks message
+func (w *Writer) ack(msg *nanachi.Delivery) {
+	err := msg.Ack(false)
+	if err != nil {
+		w.logger.Error("Ack failed: ", err)
+		return
+	}
+
+	acked.Inc(w.name)
+}
+
+// decode decompresses and decodes message according to its content encoding
+// and type. Message, larger than limit after decompression, fails.
+func (w *Writer) decode(msg *nanachi.Delivery) (message.Message, error) {
+	body, err := message.Decompress(msg.ContentEncoding, msg.Body, w.config.MaxBodySize)
+	if err != nil {
+		return message.Message{}, err
+	}
+
+	return message.DecodeContent(msg.ContentType, body)
+}
+
+// expand adds every row of message to batch
+func (w *Writer) expand(msg *nanachi.Delivery, id string, parsed message.Message) {
+	rows := parsed.Split()
+
+	// Nothing to insert
+	if len(rows) == 0 {
+		w.setCommitted(id)
+		w.ack(msg)
+		return
+	}
+
+	d := newDelivery(msg, id, len(rows))
+	size := len(msg.Body) / len(rows)
+
+	vals := make([]*toSend, len(rows))
+
+	for i, row := range rows {
+		vals[i] = &toSend{
+			id:       rowID(id, i, len(rows)),
+			parsed:   row,
+			delivery: d,
+			row:      i,
+			size:     size,
 		}
+	}
 
+	w.add(parsed.Query, vals)
+}
+
+// IsAccessible checks Clickhouse status
+func (w *Writer) IsAccessible() bool {
+	err := w.ping()
+	if err != nil {
 		w.logger.Error("Ping failed: ", err)
-		time.Sleep(time.Second)
+		return false
 	}
 
-	return false
+	return true
 }
 
-func (w *Writer) sendAll() {
-	for query := range w.toSendVals {
-		w.sendOne(query)
+// send writes batch and returns used mode. With deduplication token every
+// message is inserted separately with token, built from its rows only, so
+// redelivered message gets the same token, however it is batched.
+func (w *Writer) send(query string, vals []*toSend) string {
+	if !w.config.Deduplication.Token {
+		return w.sendBatch(query, vals)
 	}
-}
 
-func (w *Writer) sendOne(query string) {
-	if w.toSendCnts[query] > 0 {
-		started := time.Now()
-		w.send(query, w.toSendVals[query][0:w.toSendCnts[query]])
+	mode := modeColumnar
 
-		diffSend := time.Now().Sub(started)
-		started = time.Now()
+	for _, group := range byMessage(vals) {
+		// Not sent values are left unacked to be redelivered
+		if w.abandoned() {
+			w.logger.Errorf("Abandon inserts of %q on shutdown", query)
+			break
+		}
 
-		for _, v := range w.toSendVals[query][0:w.toSendCnts[query]] {
-			if v.failed {
-				w.reader.ToFailedQueue(v.nanachi)
-			}
+		if w.sendBatch(query, group) == modeRows {
+			mode = modeRows
+		}
+	}
+
+	return mode
+}
+
+// sendBatch writes values with columnar block insert if possible, otherwise
+// row by row. Returns used mode.
+func (w *Writer) sendBatch(query string, vals []*toSend) string {
+	chTypes := w.columnTypes(query)
 
-			err := v.nanachi.Ack(false)
-			if err != nil {
-				w.logger.Error("Ack failed: ", err)
+	columns, ok := makeColumns(query, chTypes, vals)
+	if ok {
+		err := w.insertBlock(w.dedupQuery(query, vals), columns, len(vals))
+		if err == nil {
+			for _, v := range vals {
+				v.sent = true
 			}
-		}
 
-		diffAck := time.Now().Sub(started)
-		w.logger.Infof("Sent %d values in %fsec, acked in %fsec for %q", w.toSendCnts[query], diffSend.Seconds(), diffAck.Seconds(), query)
+			return modeColumnar
+		}
 
-		w.toSendCnts[query] = 0
+		w.logger.Error("Columnar send failed, fallback to row by row: ", err)
 	}
+
+	w.sendRows(query, chTypes, vals)
+
+	return modeRows
 }
 
-func (w *Writer) send(query string, vals []*toSend) {
-	w.retrier.Do(func() *retrier.Error {
-		tx, err := w.db.Begin()
-		if err != nil {
-			w.logger.Error("Start transaction failed: ", err)
-			return retrier.NewError(err, false)
+// sendRows inserts values row by row. Failed transaction is retried according
+// to retry policy of error class. Values are marked as failed, if error can't
+// be retried or retries are exhausted.
+func (w *Writer) sendRows(query string, chTypes []string, vals []*toSend) {
+	attempts := make(map[string]int)
+
+	for {
+		err := w.insert(query, chTypes, vals)
+		if err != nil && isRowError(err) {
+			err = w.bisect(query, chTypes, vals, err)
 		}
 
-		stmt, err := tx.Prepare(query)
-		if err != nil {
-			tx.Rollback()
-			w.logger.Error("Prepare query failed: ", err)
+		if err == nil {
+			return
+		}
+
+		class := classify(err)
+		policy := w.policy(class)
+
+		if class == classUnknownColumn || class == classTypeMismatch {
+			w.resetSchema(query)
+		}
+		attempts[class]++
+		retries.Inc(w.name, class)
+
+		if policy.exhausted(attempts[class]) {
+			w.logger.Errorf("Give up after %d attempts with %s error for %q: %v", attempts[class], class, query, err)
 
 			for _, v := range vals {
-				v.failed = true
+				if !v.sent && !v.failed {
+					v.fail(err)
+				}
 			}
 
-			return nil
+			return
 		}
 
-		// There is no need to commit if no one succeeded exec
-		succeded := 0
+		delay := policy.delay(attempts[class])
+		w.logger.Infof("Retry in %fsec after %s error for %q", delay.Seconds(), class, query)
 
-		for _, v := range vals {
-			if v.failed {
-				continue
-			}
+		// Values are left not sent and not failed to not ack them
+		select {
+		case <-time.After(delay):
+		case <-w.abandon:
+			w.logger.Errorf("Abandon retries of %q on shutdown", query)
+			return
+		}
+	}
+}
 
-			data := w.makeCHArray(v.parsed.Data)
-			_, err := stmt.Exec(data...)
+// bisect splits batch in halves and commits each half separately until rows,
+// that cause commit failure, are isolated. Isolated rows are marked as failed.
+func (w *Writer) bisect(query string, chTypes []string, vals []*toSend, err error) error {
+	if len(vals) == 1 {
+		w.logger.Errorf("Isolated failed value %v for %q", vals[0].parsed.Data, query)
+		vals[0].fail(err)
+		return nil
+	}
 
-			if err != nil {
-				w.logger.Error("Exec failed: ", err)
-				v.failed = true
-				continue
-			}
+	w.logger.Infof("Bisect %d values for %q", len(vals), query)
 
-			succeded++
+	half := len(vals) / 2
+
+	for _, part := range [][]*toSend{vals[:half], vals[half:]} {
+		err := w.insert(query, chTypes, part)
+		if err == nil {
+			continue
 		}
 
-		if succeded == 0 {
-			tx.Rollback()
-			return nil
+		if !isRowError(err) {
+			return err
 		}
 
-		err = tx.Commit()
+		err = w.bisect(query, chTypes, part, err)
 		if err != nil {
-			w.logger.Error("Commit failed: ", err)
-			return retrier.NewError(err, false)
+			return err
 		}
+	}
 
-		return nil
-	})
+	return nil
 }
 
-func (w Writer) makeCHArray(vals []interface{}) []interface{} {
-	data := make([]interface{}, len(vals))
+// insertRows inserts not yet sent and not failed values in one transaction.
+// Values, failed on exec, are marked as failed at once. Values are converted
+// according to column types, if they are known.
+func (w *Writer) insertRows(query string, chTypes []string, vals []*toSend) error {
+	pending := 0
 
-	for i, v := range vals {
-		num, ok := v.(json.Number)
+	for _, v := range vals {
+		if !v.failed && !v.sent {
+			pending++
+		}
+	}
+
+	if pending == 0 {
+		return nil
+	}
+
+	tx, err := w.db.Begin()
+	if err != nil {
+		w.logger.Error("Start transaction failed: ", err)
+		return &stageError{stage: reader.StagePrepare, err: err}
+	}
+
+	stmt, err := tx.Prepare(w.dedupQuery(query, vals))
+	if err != nil {
+		tx.Rollback()
+		w.logger.Error("Prepare query failed: ", err)
+		return &stageError{stage: reader.StagePrepare, err: err}
+	}
 
-		if !ok {
-			data[i] = v
+	// There is no need to commit if no one succeeded exec
+	succeded := 0
+	execFailed := false
+
+	for _, v := range vals {
+		if v.failed || v.sent {
 			continue
 		}
 
-		convI, err := num.Int64()
-		if err == nil {
-			data[i] = convI
+		var data []interface{}
+
+		if chTypes != nil {
+			data, err = convertRow(chTypes, v.parsed.Data)
+		} else {
+			data, err = w.makeCHArray(v.parsed.Data)
+		}
+
+		if err != nil {
+			w.logger.Error("Convert failed: ", err)
+			v.fail(&stageError{stage: reader.StageExec, err: err})
 			continue
 		}
 
-		convF, err := num.Float64()
-		if err == nil {
-			data[i] = convF
+		_, err = stmt.Exec(data...)
+		if err != nil {
+			w.logger.Error("Exec failed: ", err)
+			v.fail(&stageError{stage: reader.StageExec, err: err})
+			execFailed = true
 			continue
 		}
 
-		data[i] = v
+		succeded++
+	}
+
+	// Table schema could be changed
+	if execFailed {
+		w.resetSchema(query)
+	}
+
+	if succeded == 0 {
+		tx.Rollback()
+		return nil
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		w.logger.Error("Commit failed: ", err)
+		return &stageError{stage: reader.StageCommit, err: err}
+	}
+
+	for _, v := range vals {
+		if !v.failed {
+			v.sent = true
+		}
+	}
+
+	return nil
+}
+
+func (w Writer) makeCHArray(vals []interface{}) ([]interface{}, error) {
+	data := make([]interface{}, len(vals))
+
+	for i, v := range vals {
+		conv, err := convertNumber(v)
+		if err != nil {
+			return nil, fmt.Errorf("column %d: %v", i, err)
+		}
+
+		data[i] = conv
 	}
 
-	return data
+	return data, nil
 }
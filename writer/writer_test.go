@@ -0,0 +1,216 @@
+package writer
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"go.uber.org/zap"
+)
+
+// fakeInserter fails transaction with row error, if it has poison value, like
+// ClickHouse does. Errors are returned first, if set.
+type fakeInserter struct {
+	poison map[string]bool
+	errs   []error
+	calls  int
+}
+
+func (f *fakeInserter) insert(query string, chTypes []string, vals []*toSend) error {
+	f.calls++
+
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+
+		return err
+	}
+
+	for _, v := range vals {
+		if !v.sent && !v.failed && f.poison[v.id] {
+			return &clickhouse.Exception{Code: 27, Message: "cannot parse " + v.id}
+		}
+	}
+
+	for _, v := range vals {
+		if !v.failed {
+			v.sent = true
+		}
+	}
+
+	return nil
+}
+
+func newTestWriter(f *fakeInserter) *Writer {
+	w := &Writer{
+		name:     "test",
+		logger:   zap.NewNop().Sugar(),
+		abandon:  make(chan struct{}),
+		schemas:  make(map[string]map[string]string),
+		schemasM: &sync.Mutex{},
+		config: writerConfig{
+			Retry: map[string]retryPolicy{
+				classRow:     {MaxAttempts: 1},
+				classNetwork: {MaxAttempts: 3},
+			},
+		},
+	}
+
+	w.insert = f.insert
+
+	return w
+}
+
+func testValues(n int) []*toSend {
+	vals := make([]*toSend, n)
+
+	for i := range vals {
+		vals[i] = &toSend{id: strconv.Itoa(i)}
+	}
+
+	return vals
+}
+
+func TestBisect(t *testing.T) {
+	for _, poison := range []int{0, 5, 7} {
+		f := &fakeInserter{poison: map[string]bool{strconv.Itoa(poison): true}}
+		w := newTestWriter(f)
+
+		vals := testValues(8)
+		w.sendRows("INSERT INTO db.t (a) VALUES (?)", nil, vals)
+
+		for i, v := range vals {
+			if i == poison {
+				if !v.failed || v.sent || v.failure.Code != 27 {
+					t.Errorf("poison %d: value is not isolated: %+v", poison, v)
+				}
+
+				continue
+			}
+
+			if !v.sent || v.failed {
+				t.Errorf("poison %d: value %d is not sent: %+v", poison, i, v)
+			}
+		}
+
+		// Batch, then halves down to poison row: 1 + 2 * log2(8)
+		if f.calls != 7 {
+			t.Errorf("poison %d: got %d inserts, want 7", poison, f.calls)
+		}
+	}
+}
+
+func TestBisectManyPoisonRows(t *testing.T) {
+	f := &fakeInserter{poison: map[string]bool{"1": true, "2": true, "6": true}}
+	w := newTestWriter(f)
+
+	vals := testValues(8)
+	w.sendRows("INSERT INTO db.t (a) VALUES (?)", nil, vals)
+
+	for i, v := range vals {
+		if f.poison[v.id] != v.failed || v.failed == v.sent {
+			t.Errorf("value %d: failed %v, sent %v", i, v.failed, v.sent)
+		}
+	}
+}
+
+func TestBisectFallsBackToRetry(t *testing.T) {
+	network := &clickhouse.Exception{Code: 210, Message: "network error"}
+
+	// Row error of batch, then network error of first half during bisection
+	f := &fakeInserter{
+		poison: map[string]bool{"3": true},
+		errs:   []error{&clickhouse.Exception{Code: 27}, network},
+	}
+	w := newTestWriter(f)
+
+	vals := testValues(4)
+	w.sendRows("INSERT INTO db.t (a) VALUES (?)", nil, vals)
+
+	for i, v := range vals {
+		if i == 3 {
+			if !v.failed {
+				t.Errorf("poison value is not isolated after retry: %+v", v)
+			}
+
+			continue
+		}
+
+		if !v.sent {
+			t.Errorf("value %d is not sent after retry: %+v", i, v)
+		}
+	}
+
+	// Network errors, that exhaust retries, fail not sent values with
+	// network error
+	f = &fakeInserter{errs: []error{&clickhouse.Exception{Code: 27}, network, network, network}}
+	w = newTestWriter(f)
+
+	vals = testValues(4)
+	w.sendRows("INSERT INTO db.t (a) VALUES (?)", nil, vals)
+
+	for i, v := range vals {
+		if !v.failed || v.class != classNetwork {
+			t.Errorf("value %d is not failed with network error: %+v", i, v)
+		}
+	}
+
+	if f.calls != 4 {
+		t.Errorf("got %d inserts, want 4", f.calls)
+	}
+}
+
+func TestSendRowsOtherError(t *testing.T) {
+	f := &fakeInserter{errs: []error{errors.New("unknown")}}
+	w := newTestWriter(f)
+	w.config.Retry[classOther] = retryPolicy{MaxAttempts: 1}
+
+	vals := testValues(2)
+	w.sendRows("INSERT INTO db.t (a) VALUES (?)", nil, vals)
+
+	// Not row error isn't bisected
+	if f.calls != 1 {
+		t.Errorf("got %d inserts, want 1", f.calls)
+	}
+
+	for i, v := range vals {
+		if !v.failed || v.sent {
+			t.Errorf("value %d is not failed: %+v", i, v)
+		}
+	}
+}
+
+func TestClickhouseURI(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{
+			in:  "tcp://127.0.0.1:9000?debug=true",
+			out: "tcp://127.0.0.1:9000?debug=true&low_cardinality_allow_in_native_format=false",
+		},
+		{
+			in:  "tcp://127.0.0.1:9000?low_cardinality_allow_in_native_format=true",
+			out: "tcp://127.0.0.1:9000?low_cardinality_allow_in_native_format=true",
+		},
+	}
+
+	for _, tt := range tests {
+		out, err := clickhouseURI(tt.in)
+		if err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+			continue
+		}
+
+		if out != tt.out {
+			t.Errorf("%s: got %s, want %s", tt.in, out, tt.out)
+		}
+	}
+
+	_, err := clickhouseURI("%zz")
+	if err == nil {
+		t.Error("expected error for invalid URI")
+	}
+}